@@ -15,3 +15,22 @@
 package constants
 
 const ProjectName = "plugin"
+
+// Version is the git tag or commit of the build, set by ldflags.
+var Version string
+
+// AnnotationPrefix is the prefix of annotations recognized by the plugin on templates.
+const AnnotationPrefix = "drone-k8s-plugin/"
+
+const (
+	// AnnotationHook declares the object as a hook, the value is the hook phase.
+	AnnotationHook = AnnotationPrefix + "hook"
+	// AnnotationHookDeletePolicy defines when the hook object is deleted, multiple policies are separated by commas.
+	AnnotationHookDeletePolicy = AnnotationPrefix + "hook-delete-policy"
+)
+
+// AnnotationForceReplace overrides the force_replace setting of the object, the value is `true` or `false`.
+const AnnotationForceReplace = AnnotationPrefix + "force-replace"
+
+// AnnotationApplyPolicy defines how the object is applied when it exists, the value is `create-only` or `replace`.
+const AnnotationApplyPolicy = AnnotationPrefix + "apply-policy"
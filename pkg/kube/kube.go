@@ -22,6 +22,8 @@ import (
 
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/util/flowcontrol"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/redact"
 )
 
 type Config struct {
@@ -31,6 +33,23 @@ type Config struct {
 	Token   string `json:"token"`
 }
 
+// String masks the secrets, so they will not be printed in logs.
+func (c Config) String() string {
+	return fmt.Sprintf("{Server:%s SkipTLS:%t CaCrt:%s Token:%s}", c.Server, c.SkipTLS, mask(c.CaCrt), mask(c.Token))
+}
+
+// GoString masks the secrets, so they will not be printed in logs.
+func (c Config) GoString() string {
+	return fmt.Sprintf("kube.Config{Server:%q, SkipTLS:%t, CaCrt:%q, Token:%q}", c.Server, c.SkipTLS, mask(c.CaCrt), mask(c.Token))
+}
+
+func mask(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redact.Mask
+}
+
 func NewRestConfig(config *Config) (*rest.Config, error) {
 	var restConfig *rest.Config
 	if config.Token == "" {
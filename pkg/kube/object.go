@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strings"
 
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	pkgruntime "k8s.io/apimachinery/pkg/runtime"
@@ -27,23 +28,57 @@ import (
 
 var serializer = serializeryaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme)
 
+// ParseObject parses the YAML or JSON documents into objects,
+// the items of `List` kinds are expanded, and the empty documents are skipped.
 func ParseObject(data []byte) ([]unstructured.Unstructured, error) {
 	var result []unstructured.Unstructured
 	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 256)
-	for {
+	for index := 0; ; index++ {
 		var rawObj pkgruntime.RawExtension
 		if err := decoder.Decode(&rawObj); err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, fmt.Errorf("decode data to raw object failed: %v", err)
+			return nil, fmt.Errorf("decode document[%d] to raw object failed: %v", index, err)
+		}
+		raw := bytes.TrimSpace(rawObj.Raw)
+		if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+			continue
 		}
 
 		var obj unstructured.Unstructured
-		if err := pkgruntime.DecodeInto(serializer, rawObj.Raw, &obj); err != nil {
-			return nil, fmt.Errorf("decode raw object failed: %v", err)
+		if err := pkgruntime.DecodeInto(serializer, raw, &obj); err != nil {
+			return nil, fmt.Errorf("decode document[%d] failed: %v", index, err)
+		}
+		objs, err := expandList(obj)
+		if err != nil {
+			return nil, fmt.Errorf("expand document[%d] failed: %v", index, err)
+		}
+		result = append(result, objs...)
+	}
+	return result, nil
+}
+
+// expandList returns the items of `List` kinds recursively, or obj itself if it is not a list.
+func expandList(obj unstructured.Unstructured) ([]unstructured.Unstructured, error) {
+	if !strings.HasSuffix(obj.GetKind(), "List") || !obj.IsList() {
+		return []unstructured.Unstructured{obj}, nil
+	}
+	list, err := obj.ToList()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []unstructured.Unstructured
+	for i, item := range list.Items {
+		if item.GetAPIVersion() == "" || item.GetKind() == "" {
+			return nil, fmt.Errorf("items[%d] of %s: apiVersion and kind must be defined", i, obj.GetKind())
+		}
+		objs, err := expandList(item)
+		if err != nil {
+			return nil, err
 		}
-		result = append(result, obj)
+		result = append(result, objs...)
 	}
 	return result, nil
 }
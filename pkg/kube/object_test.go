@@ -0,0 +1,88 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseObject(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "empty data",
+			data: "",
+		},
+		{
+			name: "multiple documents with empty ones",
+			data: "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n---\n---\n# comment\n---\napiVersion: v1\nkind: Secret\nmetadata:\n  name: b\n",
+			want: []string{"ConfigMap/a", "Secret/b"},
+		},
+		{
+			name: "json document",
+			data: `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "a"}}`,
+			want: []string{"ConfigMap/a"},
+		},
+		{
+			name: "list expanded",
+			data: "apiVersion: v1\nkind: List\nitems:\n- apiVersion: v1\n  kind: ConfigMap\n  metadata:\n    name: a\n- apiVersion: v1\n  kind: Service\n  metadata:\n    name: b\n",
+			want: []string{"ConfigMap/a", "Service/b"},
+		},
+		{
+			name: "typed list expanded",
+			data: "apiVersion: v1\nkind: ConfigMapList\nitems:\n- apiVersion: v1\n  kind: ConfigMap\n  metadata:\n    name: a\n",
+			want: []string{"ConfigMap/a"},
+		},
+		{
+			name: "nested list expanded",
+			data: "apiVersion: v1\nkind: List\nitems:\n- apiVersion: v1\n  kind: List\n  items:\n  - apiVersion: v1\n    kind: ConfigMap\n    metadata:\n      name: a\n",
+			want: []string{"ConfigMap/a"},
+		},
+		{
+			name: "empty list",
+			data: "apiVersion: v1\nkind: List\nitems: []\n",
+		},
+		{
+			name:    "list item without kind",
+			data:    "apiVersion: v1\nkind: List\nitems:\n- apiVersion: v1\n  metadata:\n    name: a\n",
+			wantErr: true,
+		},
+		{
+			name:    "document without kind",
+			data:    "apiVersion: v1\nmetadata:\n  name: a\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs, err := ParseObject([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseObject() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, obj := range objs {
+				got = append(got, obj.GetKind()+"/"+obj.GetName())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseObject() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
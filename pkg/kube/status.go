@@ -0,0 +1,136 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Condition is the common fields of `status.conditions`.
+type Condition struct {
+	Type    string
+	Status  string
+	Reason  string
+	Message string
+	// ObservedGeneration is the generation the condition is set for, it is 0 if not set.
+	ObservedGeneration int64
+}
+
+// FindCondition returns the condition of the type in `status.conditions`.
+func FindCondition(obj *unstructured.Unstructured, conditionType string) (*Condition, bool) {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, v := range conditions {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		condition := &Condition{}
+		condition.Type, _ = m["type"].(string)
+		if condition.Type != conditionType {
+			continue
+		}
+		condition.Status, _ = m["status"].(string)
+		condition.Reason, _ = m["reason"].(string)
+		condition.Message, _ = m["message"].(string)
+		switch v := m["observedGeneration"].(type) {
+		case int64:
+			condition.ObservedGeneration = v
+		case float64:
+			condition.ObservedGeneration = int64(v)
+		}
+		return condition, true
+	}
+	return nil, false
+}
+
+// IsWorkload reports whether the kind has a built-in rollout status.
+func IsWorkload(kind string) bool {
+	switch kind {
+	case "Deployment", "StatefulSet", "DaemonSet":
+		return true
+	}
+	return false
+}
+
+// WorkloadReady reports whether the rollout of the workload is complete like `kubectl rollout status`,
+// the message describes the progress when it is not ready,
+// the error is returned if the rollout is failed.
+func WorkloadReady(obj *unstructured.Unstructured) (bool, string, error) {
+	generation := obj.GetGeneration()
+	observedGeneration, _, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+	if generation > observedGeneration {
+		return false, "waiting for the rollout to be observed", nil
+	}
+
+	status := func(field string) int64 {
+		v, _, _ := unstructured.NestedInt64(obj.Object, "status", field)
+		return v
+	}
+	replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if !found {
+		replicas = 1
+	}
+
+	switch obj.GetKind() {
+	case "Deployment":
+		if condition, ok := FindCondition(obj, "Progressing"); ok && condition.Reason == "ProgressDeadlineExceeded" {
+			return false, "", fmt.Errorf("deployment %s exceeded its progress deadline: %s", obj.GetName(), condition.Message)
+		}
+		if updated := status("updatedReplicas"); updated < replicas {
+			return false, fmt.Sprintf("%d out of %d new replicas have been updated", updated, replicas), nil
+		}
+		if total, updated := status("replicas"), status("updatedReplicas"); total > updated {
+			return false, fmt.Sprintf("%d old replicas are pending termination", total-updated), nil
+		}
+		if available, updated := status("availableReplicas"), status("updatedReplicas"); available < updated {
+			return false, fmt.Sprintf("%d of %d updated replicas are available", available, updated), nil
+		}
+	case "StatefulSet":
+		strategy, _, _ := unstructured.NestedString(obj.Object, "spec", "updateStrategy", "type")
+		if strategy == "OnDelete" {
+			return true, "", nil
+		}
+		if ready := status("readyReplicas"); ready < replicas {
+			return false, fmt.Sprintf("%d of %d replicas are ready", ready, replicas), nil
+		}
+		partition, _, _ := unstructured.NestedInt64(obj.Object, "spec", "updateStrategy", "rollingUpdate", "partition")
+		if partition > 0 {
+			if updated := status("updatedReplicas"); updated < replicas-partition {
+				return false, fmt.Sprintf("%d of %d partitioned replicas have been updated", updated, replicas-partition), nil
+			}
+			return true, "", nil
+		}
+		currentRevision, _, _ := unstructured.NestedString(obj.Object, "status", "currentRevision")
+		updateRevision, _, _ := unstructured.NestedString(obj.Object, "status", "updateRevision")
+		if currentRevision != updateRevision {
+			return false, fmt.Sprintf("waiting for the rollout to revision %s", updateRevision), nil
+		}
+	case "DaemonSet":
+		strategy, _, _ := unstructured.NestedString(obj.Object, "spec", "updateStrategy", "type")
+		if strategy == "OnDelete" {
+			return true, "", nil
+		}
+		desired := status("desiredNumberScheduled")
+		if updated := status("updatedNumberScheduled"); updated < desired {
+			return false, fmt.Sprintf("%d out of %d new pods have been updated", updated, desired), nil
+		}
+		if available := status("numberAvailable"); available < desired {
+			return false, fmt.Sprintf("%d of %d updated pods are available", available, desired), nil
+		}
+	}
+	return true, "", nil
+}
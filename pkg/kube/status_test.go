@@ -0,0 +1,272 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func mustParseObject(t *testing.T, data string) *unstructured.Unstructured {
+	t.Helper()
+	objs, err := ParseObject([]byte(data))
+	if err != nil || len(objs) != 1 {
+		t.Fatalf("ParseObject() = %d objects, error = %v", len(objs), err)
+	}
+	return &objs[0]
+}
+
+func TestFindCondition(t *testing.T) {
+	obj := mustParseObject(t, `
+apiVersion: cert-manager.io/v1
+kind: Certificate
+metadata:
+  name: app
+status:
+  conditions:
+  - type: Issuing
+    status: "False"
+  - type: Ready
+    status: "True"
+    reason: Ready
+    message: certificate is up to date
+    observedGeneration: 3
+`)
+
+	tests := []struct {
+		name          string
+		conditionType string
+		want          *Condition
+		wantOk        bool
+	}{
+		{
+			name:          "found",
+			conditionType: "Ready",
+			want: &Condition{
+				Type:               "Ready",
+				Status:             "True",
+				Reason:             "Ready",
+				Message:            "certificate is up to date",
+				ObservedGeneration: 3,
+			},
+			wantOk: true,
+		},
+		{
+			name:          "without observed generation",
+			conditionType: "Issuing",
+			want:          &Condition{Type: "Issuing", Status: "False"},
+			wantOk:        true,
+		},
+		{
+			name:          "not found",
+			conditionType: "Failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := FindCondition(obj, tt.conditionType)
+			if ok != tt.wantOk {
+				t.Fatalf("FindCondition() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FindCondition() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkloadReady(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		want        bool
+		wantMessage string
+		wantErr     bool
+	}{
+		{
+			name: "generation not observed",
+			data: `
+kind: Deployment
+metadata: {name: app, generation: 2}
+spec: {replicas: 1}
+status: {observedGeneration: 1, replicas: 1, updatedReplicas: 1, availableReplicas: 1}
+`,
+			wantMessage: "waiting for the rollout to be observed",
+		},
+		{
+			name: "deployment progress deadline exceeded",
+			data: `
+kind: Deployment
+metadata: {name: app, generation: 1}
+spec: {replicas: 1}
+status:
+  observedGeneration: 1
+  conditions:
+  - {type: Progressing, status: "False", reason: ProgressDeadlineExceeded, message: timed out}
+`,
+			wantErr: true,
+		},
+		{
+			name: "deployment replicas not updated",
+			data: `
+kind: Deployment
+metadata: {name: app, generation: 1}
+spec: {replicas: 3}
+status: {observedGeneration: 1, replicas: 3, updatedReplicas: 1}
+`,
+			wantMessage: "1 out of 3 new replicas have been updated",
+		},
+		{
+			name: "deployment old replicas pending termination",
+			data: `
+kind: Deployment
+metadata: {name: app, generation: 1}
+spec: {replicas: 2}
+status: {observedGeneration: 1, replicas: 3, updatedReplicas: 2}
+`,
+			wantMessage: "1 old replicas are pending termination",
+		},
+		{
+			name: "deployment replicas not available",
+			data: `
+kind: Deployment
+metadata: {name: app, generation: 1}
+spec: {replicas: 2}
+status: {observedGeneration: 1, replicas: 2, updatedReplicas: 2, availableReplicas: 1}
+`,
+			wantMessage: "1 of 2 updated replicas are available",
+		},
+		{
+			name: "deployment ready with default replicas",
+			data: `
+kind: Deployment
+metadata: {name: app, generation: 1}
+status: {observedGeneration: 1, replicas: 1, updatedReplicas: 1, availableReplicas: 1}
+`,
+			want: true,
+		},
+		{
+			name: "statefulset on delete",
+			data: `
+kind: StatefulSet
+metadata: {name: app, generation: 1}
+spec: {replicas: 2, updateStrategy: {type: OnDelete}}
+status: {observedGeneration: 1}
+`,
+			want: true,
+		},
+		{
+			name: "statefulset replicas not ready",
+			data: `
+kind: StatefulSet
+metadata: {name: app, generation: 1}
+spec: {replicas: 2}
+status: {observedGeneration: 1, readyReplicas: 1}
+`,
+			wantMessage: "1 of 2 replicas are ready",
+		},
+		{
+			name: "statefulset partition not updated",
+			data: `
+kind: StatefulSet
+metadata: {name: app, generation: 1}
+spec: {replicas: 3, updateStrategy: {type: RollingUpdate, rollingUpdate: {partition: 1}}}
+status: {observedGeneration: 1, readyReplicas: 3, updatedReplicas: 1}
+`,
+			wantMessage: "1 of 2 partitioned replicas have been updated",
+		},
+		{
+			name: "statefulset partition updated",
+			data: `
+kind: StatefulSet
+metadata: {name: app, generation: 1}
+spec: {replicas: 3, updateStrategy: {type: RollingUpdate, rollingUpdate: {partition: 1}}}
+status: {observedGeneration: 1, readyReplicas: 3, updatedReplicas: 2}
+`,
+			want: true,
+		},
+		{
+			name: "statefulset revision not updated",
+			data: `
+kind: StatefulSet
+metadata: {name: app, generation: 1}
+spec: {replicas: 1}
+status: {observedGeneration: 1, readyReplicas: 1, currentRevision: app-1, updateRevision: app-2}
+`,
+			wantMessage: "waiting for the rollout to revision app-2",
+		},
+		{
+			name: "statefulset ready",
+			data: `
+kind: StatefulSet
+metadata: {name: app, generation: 1}
+spec: {replicas: 1}
+status: {observedGeneration: 1, readyReplicas: 1, currentRevision: app-2, updateRevision: app-2}
+`,
+			want: true,
+		},
+		{
+			name: "daemonset on delete",
+			data: `
+kind: DaemonSet
+metadata: {name: app, generation: 1}
+spec: {updateStrategy: {type: OnDelete}}
+status: {observedGeneration: 1, desiredNumberScheduled: 3}
+`,
+			want: true,
+		},
+		{
+			name: "daemonset pods not updated",
+			data: `
+kind: DaemonSet
+metadata: {name: app, generation: 1}
+status: {observedGeneration: 1, desiredNumberScheduled: 3, updatedNumberScheduled: 2}
+`,
+			wantMessage: "2 out of 3 new pods have been updated",
+		},
+		{
+			name: "daemonset pods not available",
+			data: `
+kind: DaemonSet
+metadata: {name: app, generation: 1}
+status: {observedGeneration: 1, desiredNumberScheduled: 3, updatedNumberScheduled: 3, numberAvailable: 2}
+`,
+			wantMessage: "2 of 3 updated pods are available",
+		},
+		{
+			name: "daemonset ready",
+			data: `
+kind: DaemonSet
+metadata: {name: app, generation: 1}
+status: {observedGeneration: 1, desiredNumberScheduled: 3, updatedNumberScheduled: 3, numberAvailable: 3}
+`,
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := mustParseObject(t, "apiVersion: apps/v1\n"+tt.data)
+			got, message, err := WorkloadReady(obj)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WorkloadReady() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want || message != tt.wantMessage {
+				t.Errorf("WorkloadReady() = %v, %q, want %v, %q", got, message, tt.want, tt.wantMessage)
+			}
+		})
+	}
+}
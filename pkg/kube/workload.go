@@ -0,0 +1,90 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// PodSpecPath returns the field path of the pod spec in the workload kind,
+// returns nil if the kind is not a built-in workload.
+func PodSpecPath(kind string) []string {
+	switch kind {
+	case "Pod":
+		return []string{"spec"}
+	case "Deployment", "ReplicaSet", "StatefulSet", "DaemonSet", "Job", "ReplicationController":
+		return []string{"spec", "template", "spec"}
+	case "CronJob":
+		return []string{"spec", "jobTemplate", "spec", "template", "spec"}
+	}
+	return nil
+}
+
+// PodTemplateMetadataPath returns the field path of the pod template metadata in the workload kind,
+// returns nil if the kind has no pod template.
+func PodTemplateMetadataPath(kind string) []string {
+	path := PodSpecPath(kind)
+	if len(path) < 2 {
+		return nil
+	}
+	current := make([]string, len(path))
+	copy(current, path)
+	current[len(current)-1] = "metadata"
+	return current
+}
+
+// ContainerFields are the fields of pod spec which contain containers.
+var ContainerFields = []string{"initContainers", "containers", "ephemeralContainers"}
+
+// ContainerImages returns the images of all containers in the workload object.
+func ContainerImages(obj *unstructured.Unstructured) []string {
+	var images []string
+	_ = VisitContainers(obj, func(container map[string]interface{}) error {
+		if image, ok := container["image"].(string); ok && image != "" {
+			images = append(images, image)
+		}
+		return nil
+	})
+	return images
+}
+
+// VisitContainers calls fn for each container in the workload object,
+// changes to the container will be written back to the object.
+func VisitContainers(obj *unstructured.Unstructured, fn func(container map[string]interface{}) error) error {
+	podSpecPath := PodSpecPath(obj.GetKind())
+	if podSpecPath == nil {
+		return nil
+	}
+	for _, field := range ContainerFields {
+		path := append(podSpecPath[:len(podSpecPath):len(podSpecPath)], field)
+		containers, found, err := unstructured.NestedSlice(obj.Object, path...)
+		if err != nil || !found {
+			continue
+		}
+		for _, v := range containers {
+			container, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if err := fn(container); err != nil {
+				return err
+			}
+		}
+		if err := unstructured.SetNestedSlice(obj.Object, containers, path...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
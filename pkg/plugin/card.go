@@ -0,0 +1,111 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime/debug"
+
+	"github.com/99nil/gopkg/sets"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/constants"
+	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+)
+
+// cardSchemaURL is the adaptive card template used to render the card data in the Drone UI,
+// it is formatted with the tag or commit of the build, so the template always matches the card data.
+const cardSchemaURL = "https://raw.githubusercontent.com/zc2638/drone-k8s-plugin/%s/card.json"
+
+// cardSchema returns the card template pinned to constants.Version,
+// or to the VCS revision stamped by the go command if the version is not set by ldflags.
+func cardSchema() string {
+	ref := constants.Version
+	if ref == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "vcs.revision" {
+					ref = setting.Value
+				}
+			}
+		}
+	}
+	if ref == "" {
+		// development builds without VCS information
+		ref = "main"
+	}
+	return fmt.Sprintf(cardSchemaURL, ref)
+}
+
+type card struct {
+	Schema string   `json:"schema"`
+	Data   cardData `json:"data"`
+}
+
+type cardData struct {
+	Server    string       `json:"server"`
+	Namespace string       `json:"namespace"`
+	Status    string       `json:"status"`
+	Error     string       `json:"error,omitempty"`
+	Objects   []ReportItem `json:"objects"`
+	Images    []string     `json:"images"`
+}
+
+// writeCard writes the deployment summary as a Drone card to the file path.
+func writeCard(filePath string, cfg *Config, report *Report, objSets ...[][]unstructured.Unstructured) error {
+	// the card is visible to anyone who can view the build, the errors are redacted like the report file.
+	report.mu.Lock()
+	redacted := report.redacted()
+	report.mu.Unlock()
+
+	data := cardData{
+		Server:    cfg.Kubernetes.Server,
+		Namespace: cfg.Namespace,
+		Status:    "success",
+		Error:     redacted.Error,
+		Objects:   redacted.Items,
+		Images:    collectImages(objSets...),
+	}
+	if !redacted.Success {
+		data.Status = "failure"
+	}
+
+	b, err := json.Marshal(&card{Schema: cardSchema(), Data: data})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, b, 0644)
+}
+
+func collectImages(objSets ...[][]unstructured.Unstructured) []string {
+	set := sets.New[string]()
+	images := make([]string, 0)
+	for _, objSet := range objSets {
+		for _, objs := range objSet {
+			for i := range objs {
+				for _, image := range kube.ContainerImages(&objs[i]) {
+					if set.Has(image) {
+						continue
+					}
+					set.Add(image)
+					images = append(images, image)
+				}
+			}
+		}
+	}
+	return images
+}
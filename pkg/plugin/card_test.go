@@ -0,0 +1,75 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/constants"
+	"github.com/zc2638/drone-k8s-plugin/pkg/redact"
+)
+
+func TestWriteCard(t *testing.T) {
+	version := constants.Version
+	constants.Version = "v1.2.3"
+	defer func() { constants.Version = version }()
+
+	redactor := redact.New()
+	redactor.AddValues("s3cr3t-token")
+	cfg := &Config{Namespace: "default", redactor: redactor}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Secret")
+	obj.SetName("app")
+
+	report := NewReport(redactor)
+	report.Add(obj, ActionCreated, time.Now(), errors.New("invalid value s3cr3t-token"))
+	report.Finish(errors.New("invalid value s3cr3t-token"))
+
+	filePath := filepath.Join(t.TempDir(), "card.json")
+	if err := writeCard(filePath, cfg, report); err != nil {
+		t.Fatalf("writeCard() error = %v", err)
+	}
+	b, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "s3cr3t-token") {
+		t.Errorf("card = %s, the secret value is not redacted", b)
+	}
+
+	var got card
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://raw.githubusercontent.com/zc2638/drone-k8s-plugin/v1.2.3/card.json"; got.Schema != want {
+		t.Errorf("Schema = %s, want %s", got.Schema, want)
+	}
+	if got.Data.Status != "failure" {
+		t.Errorf("Status = %s, want failure", got.Data.Status)
+	}
+	if len(got.Data.Objects) != 1 || got.Data.Objects[0].Action != ActionFailed {
+		t.Errorf("Objects = %v, want a failed object", got.Data.Objects)
+	}
+}
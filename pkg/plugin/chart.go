@@ -0,0 +1,270 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/strvals"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+)
+
+// Chart is a local Helm chart rendered in-process, no Helm release is created.
+type Chart struct {
+	// Path is the chart directory or the packaged `.tgz` file.
+	Path string `json:"path"`
+	// ReleaseName is `.Release.Name` of templates, defaults to the chart name.
+	ReleaseName string `json:"release_name"`
+	// Namespace is `.Release.Namespace` of templates, defaults to `namespace`.
+	Namespace string `json:"namespace"`
+	// ValuesFiles are the values files merged in order, the same as `--values`.
+	ValuesFiles []string `json:"values_files"`
+	// Set are the values overrides, the same as `--set`.
+	Set []string `json:"set"`
+	// SetString are the string values overrides, the same as `--set-string`.
+	SetString []string `json:"set_string"`
+}
+
+func (c *Chart) Validate() error {
+	if c.Path == "" {
+		return errors.New("path must be defined")
+	}
+	_, err := c.values()
+	return err
+}
+
+// values merges the values files and overrides.
+func (c *Chart) values() (map[string]interface{}, error) {
+	base := make(map[string]interface{})
+	for _, v := range c.ValuesFiles {
+		values, err := chartutil.ReadValuesFile(v)
+		if err != nil {
+			return nil, fmt.Errorf("read values file(%s) failed: %v", v, err)
+		}
+		base = mergeValues(base, values)
+	}
+	for _, v := range c.Set {
+		if err := strvals.ParseInto(v, base); err != nil {
+			return nil, fmt.Errorf("parse set (%s) failed: %v", v, err)
+		}
+	}
+	for _, v := range c.SetString {
+		if err := strvals.ParseIntoString(v, base); err != nil {
+			return nil, fmt.Errorf("parse set_string (%s) failed: %v", v, err)
+		}
+	}
+	return base, nil
+}
+
+// mergeValues merges b into a recursively, the values of b take precedence.
+func mergeValues(a, b map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(a))
+	for k, v := range a {
+		out[k] = v
+	}
+	for k, v := range b {
+		if bv, ok := v.(map[string]interface{}); ok {
+			if av, ok := out[k].(map[string]interface{}); ok {
+				out[k] = mergeValues(av, bv)
+				continue
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// chartCapabilities returns `.Capabilities` of templates from the cluster.
+func chartCapabilities(kubeClient kubernetes.Interface) (*chartutil.Capabilities, error) {
+	serverVersion, err := kubeClient.Discovery().ServerVersion()
+	if err != nil {
+		return nil, fmt.Errorf("get Kubernetes server version failed: %v", err)
+	}
+	_, resources, err := kubeClient.Discovery().ServerGroupsAndResources()
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, fmt.Errorf("get Kubernetes API resources failed: %v", err)
+	}
+
+	versions := make(chartutil.VersionSet, 0, len(resources))
+	for _, list := range resources {
+		versions = append(versions, list.GroupVersion)
+		for _, resource := range list.APIResources {
+			versions = append(versions, list.GroupVersion+"/"+resource.Kind)
+		}
+	}
+	return &chartutil.Capabilities{
+		KubeVersion: chartutil.KubeVersion{
+			Version: serverVersion.GitVersion,
+			Major:   serverVersion.Major,
+			Minor:   serverVersion.Minor,
+		},
+		APIVersions: versions,
+		HelmVersion: chartutil.DefaultCapabilities.HelmVersion,
+	}, nil
+}
+
+// renderCharts renders the charts into object sets, the CRDs of a chart are a set before its templates.
+// Helm hooks are not supported and skipped.
+func renderCharts(
+	charts []Chart,
+	defNamespace string,
+	kubeClient kubernetes.Interface,
+	mapping meta.RESTMapper,
+) ([][]unstructured.Unstructured, error) {
+	if len(charts) == 0 {
+		return nil, nil
+	}
+	caps, err := chartCapabilities(kubeClient)
+	if err != nil {
+		return nil, err
+	}
+
+	var objSet [][]unstructured.Unstructured
+	for _, c := range charts {
+		crdObjs, objs, err := renderChart(&c, defNamespace, caps, mapping)
+		if err != nil {
+			return nil, fmt.Errorf("render chart(%s) failed: %v", c.Path, err)
+		}
+		if len(crdObjs) > 0 {
+			objSet = append(objSet, crdObjs)
+		}
+		objSet = append(objSet, objs)
+	}
+	return objSet, nil
+}
+
+func renderChart(
+	c *Chart,
+	defNamespace string,
+	caps *chartutil.Capabilities,
+	mapping meta.RESTMapper,
+) ([]unstructured.Unstructured, []unstructured.Unstructured, error) {
+	chrt, err := loader.Load(c.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, err := c.values()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := chartutil.ProcessDependencies(chrt, values); err != nil {
+		return nil, nil, err
+	}
+
+	options := chartutil.ReleaseOptions{
+		Name:      c.ReleaseName,
+		Namespace: c.Namespace,
+		Revision:  1,
+		IsInstall: true,
+	}
+	if options.Name == "" {
+		options.Name = chrt.Name()
+	}
+	if options.Namespace == "" {
+		options.Namespace = defNamespace
+	}
+	renderValues, err := chartutil.ToRenderValues(chrt, values, options, caps)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := engine.Render(chrt, renderValues)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var crdObjs []unstructured.Unstructured
+	for _, crd := range chrt.CRDObjects() {
+		current, err := kube.ParseObject(crd.File.Data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse %s failed: %v", crd.Filename, err)
+		}
+		crdObjs = append(crdObjs, current...)
+	}
+
+	// the objects of a set are applied concurrently, so the files are only sorted for a stable order.
+	names := make([]string, 0, len(files))
+	for k := range files {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var objs []unstructured.Unstructured
+	for _, name := range names {
+		if strings.HasPrefix(path.Base(name), "_") || strings.HasSuffix(name, "NOTES.txt") {
+			continue
+		}
+		current, err := kube.ParseObject([]byte(files[name]))
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse %s failed: %v", name, err)
+		}
+		for _, obj := range current {
+			if _, ok := obj.GetAnnotations()[release.HookAnnotation]; ok {
+				logrus.WithField("chart", c.Path).
+					WithField("kind", obj.GetKind()).
+					WithField("name", obj.GetName()).
+					Warn("Skip Helm hook, it is not supported")
+				continue
+			}
+			if obj.GetNamespace() == "" {
+				namespaced, err := isNamespaced(mapping, crdObjs, obj.GroupVersionKind())
+				if err != nil {
+					return nil, nil, fmt.Errorf("parse %s failed: %v", name, err)
+				}
+				if namespaced {
+					obj.SetNamespace(options.Namespace)
+				}
+			}
+			objs = append(objs, obj)
+		}
+	}
+	logrus.WithField("chart", c.Path).
+		WithField("release", options.Name).
+		Debugf("Rendered %d objects from chart", len(crdObjs)+len(objs))
+	return crdObjs, objs, nil
+}
+
+// isNamespaced reports whether the kind is namespaced, the kinds defined by crdObjs
+// are not in the cluster yet, so their scopes are looked up from the CRDs.
+func isNamespaced(mapping meta.RESTMapper, crdObjs []unstructured.Unstructured, gvk schema.GroupVersionKind) (bool, error) {
+	for _, crd := range crdObjs {
+		group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+		kind, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "kind")
+		if group == gvk.Group && kind == gvk.Kind {
+			scope, _, _ := unstructured.NestedString(crd.Object, "spec", "scope")
+			return scope != "Cluster", nil
+		}
+	}
+
+	restMapping, err := mapping.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return false, err
+	}
+	return restMapping.Scope.Name() == meta.RESTScopeNameNamespace, nil
+}
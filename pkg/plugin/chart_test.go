@@ -0,0 +1,137 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestMergeValues(t *testing.T) {
+	tests := []struct {
+		name string
+		a    map[string]interface{}
+		b    map[string]interface{}
+		want map[string]interface{}
+	}{
+		{
+			name: "empty",
+			a:    map[string]interface{}{},
+			b:    map[string]interface{}{},
+			want: map[string]interface{}{},
+		},
+		{
+			name: "b takes precedence",
+			a:    map[string]interface{}{"replicas": 1, "name": "a"},
+			b:    map[string]interface{}{"replicas": 3},
+			want: map[string]interface{}{"replicas": 3, "name": "a"},
+		},
+		{
+			name: "nested maps merged",
+			a:    map[string]interface{}{"image": map[string]interface{}{"repository": "nginx", "tag": "1.0"}},
+			b:    map[string]interface{}{"image": map[string]interface{}{"tag": "2.0"}},
+			want: map[string]interface{}{"image": map[string]interface{}{"repository": "nginx", "tag": "2.0"}},
+		},
+		{
+			name: "map replaced by scalar",
+			a:    map[string]interface{}{"image": map[string]interface{}{"tag": "1.0"}},
+			b:    map[string]interface{}{"image": "nginx:2.0"},
+			want: map[string]interface{}{"image": "nginx:2.0"},
+		},
+		{
+			name: "scalar replaced by map",
+			a:    map[string]interface{}{"image": "nginx:1.0"},
+			b:    map[string]interface{}{"image": map[string]interface{}{"tag": "2.0"}},
+			want: map[string]interface{}{"image": map[string]interface{}{"tag": "2.0"}},
+		},
+		{
+			name: "lists replaced",
+			a:    map[string]interface{}{"args": []interface{}{"a", "b"}},
+			b:    map[string]interface{}{"args": []interface{}{"c"}},
+			want: map[string]interface{}{"args": []interface{}{"c"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeValues(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	a := map[string]interface{}{"image": map[string]interface{}{"tag": "1.0"}}
+	mergeValues(a, map[string]interface{}{"image": map[string]interface{}{"tag": "2.0"}})
+	if want := map[string]interface{}{"image": map[string]interface{}{"tag": "1.0"}}; !reflect.DeepEqual(a, want) {
+		t.Errorf("mergeValues() changed a = %v, want %v", a, want)
+	}
+}
+
+func TestRenderChart(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"Chart.yaml": "apiVersion: v2\nname: app\nversion: 0.1.0\n",
+		"crds/crontab.yaml": "apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\n" +
+			"metadata:\n  name: crontabs.example.com\nspec:\n  group: example.com\n  scope: Namespaced\n  names:\n    kind: CronTab\n",
+		"templates/app.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{ .Release.Name }}\n" +
+			"---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: other\n  namespace: other\n" +
+			"---\napiVersion: rbac.authorization.k8s.io/v1\nkind: ClusterRole\nmetadata:\n  name: app\n" +
+			"---\napiVersion: example.com/v1\nkind: CronTab\nmetadata:\n  name: app\n",
+		"templates/hook.yaml": "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: migrate\n" +
+			"  annotations:\n    helm.sh/hook: pre-install\n",
+		"templates/NOTES.txt": "Installed {{ .Release.Name }}.\n",
+	}
+	for name, content := range files {
+		filePath := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mapping := meta.NewDefaultRESTMapper(nil)
+	mapping.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapping.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}, meta.RESTScopeRoot)
+
+	c := &Chart{Path: dir, ReleaseName: "release", Namespace: "chart-ns"}
+	crdObjs, objs, err := renderChart(c, "default", chartutil.DefaultCapabilities, mapping)
+	if err != nil {
+		t.Fatalf("renderChart() error = %v", err)
+	}
+	if len(crdObjs) != 1 || crdObjs[0].GetName() != "crontabs.example.com" {
+		t.Errorf("renderChart() crdObjs = %v, want the CronTab CRD", crdObjs)
+	}
+
+	var got []string
+	for _, obj := range objs {
+		got = append(got, obj.GetKind()+"/"+obj.GetNamespace()+"/"+obj.GetName())
+	}
+	want := []string{
+		"ConfigMap/chart-ns/release",
+		"ConfigMap/other/other",
+		"ClusterRole//app",
+		"CronTab/chart-ns/app",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("renderChart() objs = %v, want %v", got, want)
+	}
+}
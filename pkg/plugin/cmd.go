@@ -15,9 +15,15 @@
 package plugin
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -26,6 +32,7 @@ import (
 
 	"github.com/zc2638/drone-k8s-plugin/pkg/constants"
 	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+	"github.com/zc2638/drone-k8s-plugin/pkg/redact"
 )
 
 type Option struct {
@@ -46,46 +53,150 @@ func NewCommand() *cobra.Command {
 		Short:        "Drone Kubernetes Plugin",
 		SilenceUsage: true,
 		Run: func(cmd *cobra.Command, args []string) {
-			cfg := opt.Config()
-			cfg.BindEnvs()
-			logrus.Infof("Config Path: %s", opt.ConfigPath)
-			if err := cfg.Parse(opt.ConfigPath, constants.ProjectName); err != nil {
-				logrus.Fatal(err)
+			cfg, envMap, kubeClient, dynamicClient := prepare(opt, true)
+			ctx, cancel := newContext(cfg)
+			defer cancel()
+			if err := run(ctx, cfg, kubeClient, dynamicClient, envMap); err != nil {
+				logrus.Fatal(contextError(ctx, err))
 			}
+		},
+	}
 
-			envMap := getEnvMap()
-			envs := envToSlice(envMap)
-			if err := cfg.Validate(envs); err != nil {
-				logrus.Fatal(err)
-			}
-			if cfg.Debug {
-				logrus.SetLevel(logrus.DebugLevel)
-			}
-			logrus.Debugf("%#v\n", cfg)
+	cmd.PersistentFlags().StringVarP(&opt.ConfigPath, "config", "c", opt.ConfigPath,
+		"config file (default is $HOME/.drone-plugin/config.yaml)")
+	cmd.AddCommand(
+		newHistoryCommand(opt),
+		newRollbackCommand(opt),
+	)
+	return cmd
+}
 
-			restConfig, err := kube.NewRestConfig(&cfg.Kubernetes)
-			if err != nil {
-				logrus.Fatal(err)
-			}
-			kubeClient, err := kubernetes.NewForConfig(restConfig)
-			if err != nil {
-				logrus.Fatal(err)
-			}
-			dynamicClient, err := dynamic.NewForConfig(restConfig)
-			if err != nil {
-				logrus.Fatal(err)
-			}
-			if err := run(cfg, kubeClient, dynamicClient, envMap); err != nil {
-				logrus.Fatal(err)
+func newHistoryCommand(opt *Option) *cobra.Command {
+	return &cobra.Command{
+		Use:          "history",
+		Short:        "List the release revisions",
+		SilenceUsage: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, _, kubeClient, _ := prepare(opt, false)
+			ctx, cancel := newContext(cfg)
+			defer cancel()
+			if err := history(ctx, cfg, kubeClient, os.Stdout); err != nil {
+				logrus.Fatal(contextError(ctx, err))
 			}
 		},
 	}
+}
 
-	cmd.Flags().StringVarP(&opt.ConfigPath, "config", "c", opt.ConfigPath,
-		"config file (default is $HOME/.drone-plugin/config.yaml)")
+func newRollbackCommand(opt *Option) *cobra.Command {
+	var revision int
+	cmd := &cobra.Command{
+		Use:          "rollback",
+		Short:        "Re-apply the manifests of a release revision",
+		SilenceUsage: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, envMap, kubeClient, dynamicClient := prepare(opt, false)
+			ctx, cancel := newContext(cfg)
+			defer cancel()
+			if err := rollback(ctx, cfg, kubeClient, dynamicClient, envMap, revision); err != nil {
+				logrus.Fatal(contextError(ctx, err))
+			}
+		},
+	}
+	cmd.Flags().IntVarP(&revision, "revision", "r", 0,
+		"the revision to roll back to (default is the previous revision)")
 	return cmd
 }
 
+// prepare parses the config, sets up logging and creates the Kubernetes clients.
+func prepare(opt *Option, requireTemplates bool) (*Config, map[string]string, kubernetes.Interface, dynamic.Interface) {
+	cfg := opt.Config()
+	cfg.BindEnvs()
+	logrus.Infof("Config Path: %s", opt.ConfigPath)
+	if err := cfg.Parse(opt.ConfigPath, constants.ProjectName); err != nil {
+		logrus.Fatal(err)
+	}
+	if cfg.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	var formatter logrus.Formatter
+	switch cfg.LogFormat {
+	case "", "text":
+		formatter = logrus.StandardLogger().Formatter
+	case "json":
+		formatter = &logrus.JSONFormatter{TimestampFormat: time.RFC3339}
+	default:
+		logrus.Fatalf("unsupported log_format (%s), please use `text` or `json`", cfg.LogFormat)
+	}
+	redactor := redact.New(cfg.SecretPatterns...)
+	redactor.AddValues(cfg.Kubernetes.Token, cfg.Kubernetes.CaCrt)
+	logrus.SetFormatter(redactor.Formatter(formatter))
+	cfg.redactor = redactor
+
+	envMap := getEnvMap()
+	redactor.AddEnv(envMap)
+	envKeys := make([]string, 0, len(envMap))
+	for k := range envMap {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+	for _, k := range envKeys {
+		logrus.Debugf("env: %s=%s", k, envMap[k])
+	}
+
+	if requireTemplates {
+		if err := cfg.ValidateTemplates(); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	envs := envToSlice(envMap)
+	if err := cfg.Validate(envs); err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Debugf("%#v\n", cfg)
+
+	restConfig, err := kube.NewRestConfig(&cfg.Kubernetes)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	redactor.AddValues(restConfig.BearerToken)
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return cfg, envMap, kubeClient, dynamicClient
+}
+
+// newContext returns the context of a run, which is canceled on SIGTERM or interrupt,
+// for Drone sends SIGTERM when the step is canceled or timed out.
+func newContext(cfg *Config) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	if cfg.Timeout <= 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// contextError explains err with the reason of the context done.
+func contextError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("timeout exceeded: %v", err)
+	case errors.Is(ctx.Err(), context.Canceled):
+		return fmt.Errorf("canceled by signal: %v", err)
+	}
+	return err
+}
+
 func getEnvMap() map[string]string {
 	envMap := make(map[string]string)
 	envs := os.Environ()
@@ -94,7 +205,6 @@ func getEnvMap() map[string]string {
 			matches := pluginExp.FindStringSubmatch(v)
 			key := strings.ToLower(matches[1])
 			envMap[key] = matches[2]
-			logrus.Debugf("env: %s=%s", key, matches[2])
 		}
 
 		parts := strings.SplitN(v, "=", 2)
@@ -102,7 +212,6 @@ func getEnvMap() map[string]string {
 			continue
 		}
 		envMap[parts[0]] = parts[1]
-		logrus.Debugf("env: %s=%s", parts[0], parts[1])
 	}
 	return envMap
 }
@@ -15,17 +15,22 @@
 package plugin
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/a8m/envsubst/parse"
+	"k8s.io/apimachinery/pkg/util/validation"
 
 	"github.com/zc2638/drone-k8s-plugin/pkg/constants"
 
 	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+	"github.com/zc2638/drone-k8s-plugin/pkg/redact"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/mitchellh/mapstructure"
@@ -33,10 +38,55 @@ import (
 )
 
 type ConfigFile struct {
-	Namespace string
-	Name      string
-	FilePath  string
-	FileName  string
+	Namespace string           `json:"namespace"`
+	Name      string           `json:"name"`
+	Files     []ConfigFileItem `json:"files"`
+	// EnvFiles are `.env` style files, each `KEY=value` line becomes a key,
+	// the same as `kubectl create configmap --from-env-file`.
+	EnvFiles []string `json:"env_files"`
+	// Literals are the literal key/value pairs,
+	// the same as `kubectl create configmap --from-literal`.
+	Literals map[string]string `json:"literals"`
+	// Values are available as `.values` when rendering templated files.
+	Values map[string]interface{} `json:"values"`
+
+	// legacy holds the colon-separated definition,
+	// e.g. `namespace:name:filepath` or `namespace:name:filepath:filename`.
+	legacy string
+}
+
+type ConfigFileItem struct {
+	// Path is the path of the config file.
+	Path string `json:"path"`
+	// Key is the key in ConfigMap data, defaults to the file name of Path.
+	Key string `json:"key"`
+	// Template defines how the file content is rendered before it is stored.
+	Template TemplateMode `json:"template"`
+}
+
+type TemplateMode string
+
+const (
+	// TemplateModeNone copies the file verbatim.
+	TemplateModeNone TemplateMode = ""
+	// TemplateModeGo renders the file through tpl.Render, enabled by `template: true`.
+	TemplateModeGo TemplateMode = "go"
+	// TemplateModeEnvsubst only substitutes the environment variables,
+	// for files that already contain go template syntax meant for the app.
+	TemplateModeEnvsubst TemplateMode = "envsubst"
+)
+
+// Output defines a value exported to the file named by `DRONE_OUTPUT` for later pipeline steps.
+type Output struct {
+	// Key is the environment variable name of the value.
+	Key        string `json:"key"`
+	APIVersion string `json:"api_version"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	// Path is the JSONPath expression evaluated on the live object,
+	// e.g. `{.spec.clusterIP}` or `.spec.ports[0].nodePort`.
+	Path string `json:"path"`
 }
 
 type Config struct {
@@ -44,11 +94,84 @@ type Config struct {
 
 	Kubernetes kube.Config `json:"kubernetes"`
 
-	InitTemplates []string `json:"init_templates"`
-	ConfigFiles   []string `json:"config_files"` // namespace:name:file, namespace:name:file
-	Templates     []string `json:"templates"`
-	Namespace     string   `json:"namespace"`
-	Debug         bool     `json:"debug"`
+	InitTemplates []string     `json:"init_templates"`
+	ConfigFiles   []ConfigFile `json:"config_files"`
+	Templates     []string     `json:"templates"`
+	Namespace     string       `json:"namespace"`
+	Debug         bool         `json:"debug"`
+	LogFormat     string       `json:"log_format"`
+	// KustomizeDirs are the kustomization directories built in-process, applied after Templates.
+	KustomizeDirs []string `json:"kustomize_dirs"`
+	// Charts are the local Helm charts rendered in-process, applied after KustomizeDirs.
+	Charts []Chart `json:"charts"`
+	// KustomizeTemplate renders the yaml files of KustomizeDirs with `.env` before building.
+	KustomizeTemplate bool `json:"kustomize_template"`
+	// ReportPath is the file path to write the run report to.
+	ReportPath string `json:"report_path"`
+	// Outputs are written to the file named by `DRONE_OUTPUT`.
+	Outputs []Output `json:"outputs"`
+
+	// WaitLoadBalancer waits until the addresses are assigned to LoadBalancer Services and Ingresses.
+	WaitLoadBalancer bool `json:"wait_load_balancer"`
+	// WaitRollout waits until the rollout of Deployments, StatefulSets and DaemonSets is complete.
+	WaitRollout bool `json:"wait_rollout"`
+	// Readiness are the rules to wait until the applied objects are ready.
+	Readiness []ReadinessRule `json:"readiness"`
+	// WaitTimeout is the timeout of waiting, defaults to 5m.
+	WaitTimeout time.Duration `json:"wait_timeout"`
+	// Lock is acquired before applying, to avoid concurrent runs for the same app.
+	Lock Lock `json:"lock"`
+
+	// History stores the release revisions for rollback.
+	History History `json:"history"`
+
+	// StampMetadata adds the Drone build metadata as annotations to the applied objects.
+	StampMetadata bool `json:"stamp_metadata"`
+	// StampPodTemplate also stamps the pod templates of workloads except Jobs and CronJobs,
+	// which rolls out the workloads on every build.
+	StampPodTemplate bool `json:"stamp_pod_template"`
+	// StampPrefix is the prefix of annotation and label keys, defaults to constants.AnnotationPrefix.
+	StampPrefix string `json:"stamp_prefix"`
+	// StampKeys are the Drone environment variables to stamp, defaults to DefaultStampKeys.
+	StampKeys []string `json:"stamp_keys"`
+	// StampLabels are the keys in StampKeys which are also added as labels.
+	StampLabels []string `json:"stamp_labels"`
+
+	// PreserveFields are the fields of live objects preserved when updating, in addition to the built-in ones.
+	PreserveFields []PreserveRule `json:"preserve_fields"`
+
+	// MaxConcurrency is the max number of objects applied in parallel, defaults to 10.
+	MaxConcurrency int `json:"max_concurrency"`
+	// Timeout is the max duration of the whole run, no limit if it is zero.
+	Timeout time.Duration `json:"timeout"`
+	// RequestTimeout is the max duration of each attempt of applying an object and of each other API request,
+	// defaults to 1m, replacing an object is bounded by WaitTimeout instead, following the hook logs is not bounded.
+	RequestTimeout time.Duration `json:"request_timeout"`
+
+	// ContinueOnError applies all objects even if some of them fail, and reports all the failures at the end.
+	ContinueOnError bool `json:"continue_on_error"`
+
+	// Retry is the backoff of retrying the transient API errors when applying objects.
+	Retry Retry `json:"retry"`
+
+	// ForceReplace deletes and recreates the objects whose update is rejected for changing immutable fields,
+	// it is overridden by the annotation constants.AnnotationForceReplace of objects.
+	ForceReplace bool `json:"force_replace"`
+
+	// Images override the container images of workloads, e.g. `nginx:1.23`, `nginx=registry.example.com/nginx@sha256:...`.
+	Images []string `json:"images"`
+	// imageOverrides holds the parsed Images.
+	imageOverrides []ImageOverride
+
+	// FailureLogLines is the number of log lines printed from the failing containers
+	// when a workload is not ready, defaults to 50.
+	FailureLogLines int64 `json:"failure_log_lines"`
+
+	// SecretPatterns are the glob patterns of environment variable names whose values are masked in logs,
+	// in addition to redact.DefaultPatterns.
+	SecretPatterns []string `json:"secret_patterns"`
+	// redactor masks the secret values in the report and card.
+	redactor *redact.Redactor
 }
 
 func (c *Config) BindEnvs() {
@@ -56,7 +179,34 @@ func (c *Config) BindEnvs() {
 	c.bindEnv("namespace")
 	c.bindEnv("init_templates")
 	c.bindEnv("templates")
+	c.bindEnv("kustomize_dirs")
+	c.bindEnv("kustomize_template")
+	c.bindEnv("charts")
 	c.bindEnv("config_files")
+	c.bindEnv("secret_patterns")
+	c.bindEnv("log_format")
+	c.bindEnv("report_path")
+	c.bindEnv("outputs")
+	c.bindEnv("wait_load_balancer")
+	c.bindEnv("wait_rollout")
+	c.bindEnv("readiness")
+	c.bindEnv("wait_timeout")
+	c.bindEnv("failure_log_lines")
+	c.bindEnv("lock")
+	c.bindEnv("history")
+	c.bindEnv("stamp_metadata")
+	c.bindEnv("stamp_pod_template")
+	c.bindEnv("stamp_prefix")
+	c.bindEnv("stamp_keys")
+	c.bindEnv("stamp_labels")
+	c.bindEnv("images")
+	c.bindEnv("preserve_fields")
+	c.bindEnv("force_replace")
+	c.bindEnv("retry")
+	c.bindEnv("continue_on_error")
+	c.bindEnv("max_concurrency")
+	c.bindEnv("timeout")
+	c.bindEnv("request_timeout")
 	c.bindEnv("kubernetes.server", "k8s.server")
 	c.bindEnv("kubernetes.token", "k8s.token")
 	c.bindEnv("kubernetes.ca_crt", "k8s.ca_crt")
@@ -85,43 +235,238 @@ func (c *Config) GetConfigFiles() []ConfigFile {
 	return c.configFiles[:]
 }
 
-func (c *Config) Validate(envs []string) error {
-	if len(c.InitTemplates) == 0 && len(c.ConfigFiles) == 0 && len(c.Templates) == 0 {
-		return errors.New("at least one of init_templates, config_files and templates is defined")
+// ValidateTemplates checks that there is something to apply.
+func (c *Config) ValidateTemplates() error {
+	if len(c.InitTemplates) == 0 && len(c.ConfigFiles) == 0 && len(c.Templates) == 0 &&
+		len(c.KustomizeDirs) == 0 && len(c.Charts) == 0 {
+		return errors.New("at least one of init_templates, config_files, templates, kustomize_dirs and charts is defined")
 	}
+	return nil
+}
 
+func (c *Config) Validate(envs []string) error {
 	parser := parse.New("string", envs, &parse.Restrictions{})
 
 	cfs := make([]ConfigFile, 0, len(c.ConfigFiles))
 	for _, v := range c.ConfigFiles {
-		val, err := parser.Parse(v)
+		cf, err := resolveConfigFile(parser, v)
+		if err != nil {
+			return err
+		}
+		for _, item := range cf.Files {
+			if _, err := os.Stat(item.Path); err != nil {
+				return fmt.Errorf("stat config file(%s) of ConfigMap %s/%s failed: %v", item.Path, cf.Namespace, cf.Name, err)
+			}
+		}
+		for _, v := range cf.EnvFiles {
+			if _, err := os.Stat(v); err != nil {
+				return fmt.Errorf("stat env file(%s) of ConfigMap %s/%s failed: %v", v, cf.Namespace, cf.Name, err)
+			}
+		}
+		cfs = append(cfs, cf)
+	}
+	if len(cfs) > 0 {
+		c.configFiles = cfs
+	}
+
+	if c.WaitTimeout <= 0 {
+		c.WaitTimeout = defaultWaitTimeout
+	}
+	if c.FailureLogLines <= 0 {
+		c.FailureLogLines = defaultFailureLogLines
+	}
+	if c.Lock.Key != "" {
+		if errs := validation.IsDNS1123Subdomain(c.Lock.Key); len(errs) > 0 {
+			return fmt.Errorf("invalid lock key (%s): %s", c.Lock.Key, strings.Join(errs, ";"))
+		}
+		if c.Lock.Namespace == "" {
+			c.Lock.Namespace = c.Namespace
+		}
+		if c.Lock.Namespace == "" {
+			return errors.New("lock namespace must be defined")
+		}
+		if c.Lock.Timeout <= 0 {
+			c.Lock.Timeout = defaultLockTimeout
+		}
+		if c.Lock.LeaseDuration < 3*time.Second {
+			c.Lock.LeaseDuration = defaultLockLeaseDuration
+		}
+	}
+
+	if c.StampMetadata {
+		if c.StampPrefix == "" {
+			c.StampPrefix = constants.AnnotationPrefix
+		}
+		keys := c.StampKeys
+		if len(keys) == 0 {
+			keys = DefaultStampKeys
+		}
+		for _, v := range keys {
+			if errs := validation.IsQualifiedName(c.StampPrefix + stampName(v)); len(errs) > 0 {
+				return fmt.Errorf("invalid stamp key (%s): %s", c.StampPrefix+stampName(v), strings.Join(errs, ";"))
+			}
+		}
+	}
+
+	if c.History.Name != "" {
+		if errs := validation.IsDNS1123Subdomain(c.History.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid history name (%s): %s", c.History.Name, strings.Join(errs, ";"))
+		}
+		if c.History.Namespace == "" {
+			c.History.Namespace = c.Namespace
+		}
+		if c.History.Namespace == "" {
+			return errors.New("history namespace must be defined")
+		}
+		if c.History.Max <= 0 {
+			c.History.Max = defaultHistoryMax
+		}
+		switch c.History.Storage {
+		case "":
+			c.History.Storage = releaseStorageSecret
+		case releaseStorageSecret, releaseStorageConfigMap:
+		default:
+			return fmt.Errorf("unsupported history storage (%s), please use `%s` or `%s`",
+				c.History.Storage, releaseStorageSecret, releaseStorageConfigMap)
+		}
+	}
+
+	c.imageOverrides = make([]ImageOverride, 0, len(c.Images))
+	for i, v := range c.Images {
+		override, err := parseImageOverride(v)
+		if err != nil {
+			return fmt.Errorf("images[%d]: %v", i, err)
+		}
+		c.imageOverrides = append(c.imageOverrides, override)
+	}
+
+	c.Retry.complete()
+	if c.MaxConcurrency <= 0 {
+		c.MaxConcurrency = defaultMaxConcurrency
+	}
+	if c.RequestTimeout <= 0 {
+		c.RequestTimeout = defaultRequestTimeout
+	}
+	if c.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+
+	for i := range c.Charts {
+		if err := c.Charts[i].Validate(); err != nil {
+			return fmt.Errorf("charts[%d]: %v", i, err)
+		}
+	}
+
+	for i := range c.PreserveFields {
+		if err := c.PreserveFields[i].Validate(); err != nil {
+			return fmt.Errorf("preserve_fields[%d]: %v", i, err)
+		}
+	}
+
+	for i := range c.Readiness {
+		if err := c.Readiness[i].Validate(); err != nil {
+			return fmt.Errorf("readiness[%d]: %v", i, err)
+		}
+	}
+
+	for i, v := range c.Outputs {
+		if !envNameExp.MatchString(v.Key) {
+			return fmt.Errorf("outputs[%d]: invalid key (%s), it must be a valid environment variable name", i, v.Key)
+		}
+		if v.APIVersion == "" || v.Kind == "" || v.Name == "" || v.Path == "" {
+			return fmt.Errorf("outputs[%d]: api_version, kind, name and path must be defined", i)
+		}
+		if _, err := parseJSONPath(v.Key, v.Path); err != nil {
+			return fmt.Errorf("outputs[%d]: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+func resolveConfigFile(parser *parse.Parser, in ConfigFile) (ConfigFile, error) {
+	if in.legacy != "" {
+		val, err := parser.Parse(in.legacy)
 		if err != nil {
-			return fmt.Errorf("parse env variable failed: %v", err)
+			return ConfigFile{}, fmt.Errorf("parse env variable failed: %v", err)
 		}
 
-		cf := ConfigFile{}
+		item := ConfigFileItem{}
 		parts := strings.Split(val, ":")
 		switch len(parts) {
 		case 3:
 		case 4:
-			cf.FileName = parts[3]
+			item.Key = parts[3]
 		default:
-			return fmt.Errorf("config file (%s) format error, please use `namespace:name:file` or `namespace:name:filepath:filename` to define", val)
+			return ConfigFile{}, fmt.Errorf("config file (%s) format error, please use `namespace:name:file` or `namespace:name:filepath:filename` to define", val)
+		}
+		item.Path = parts[2]
+		in = ConfigFile{
+			Namespace: parts[0],
+			Name:      parts[1],
+			Files:     []ConfigFileItem{item},
+		}
+	} else {
+		var err error
+		if in.Namespace, err = parser.Parse(in.Namespace); err != nil {
+			return ConfigFile{}, fmt.Errorf("parse env variable failed: %v", err)
+		}
+		if in.Name, err = parser.Parse(in.Name); err != nil {
+			return ConfigFile{}, fmt.Errorf("parse env variable failed: %v", err)
+		}
+		files := make([]ConfigFileItem, 0, len(in.Files))
+		for _, item := range in.Files {
+			if item.Path, err = parser.Parse(item.Path); err != nil {
+				return ConfigFile{}, fmt.Errorf("parse env variable failed: %v", err)
+			}
+			if item.Key, err = parser.Parse(item.Key); err != nil {
+				return ConfigFile{}, fmt.Errorf("parse env variable failed: %v", err)
+			}
+			files = append(files, item)
 		}
-		cf.Namespace = parts[0]
-		cf.Name = parts[1]
-		cf.FilePath = parts[2]
+		in.Files = files
 
-		if _, err := os.Stat(cf.FilePath); err != nil {
-			return fmt.Errorf("stat config file(%s) failed: %v", val, err)
+		envFiles := make([]string, 0, len(in.EnvFiles))
+		for _, v := range in.EnvFiles {
+			val, err := parser.Parse(v)
+			if err != nil {
+				return ConfigFile{}, fmt.Errorf("parse env variable failed: %v", err)
+			}
+			envFiles = append(envFiles, val)
 		}
-		cfs = append(cfs, cf)
-	}
-	if len(cfs) > 0 {
-		c.configFiles = cfs
+		in.EnvFiles = envFiles
 	}
 
-	return nil
+	if in.Namespace == "" || in.Name == "" {
+		return ConfigFile{}, fmt.Errorf("config file namespace and name must be defined, namespace=%s, name=%s", in.Namespace, in.Name)
+	}
+	if len(in.Files) == 0 && len(in.EnvFiles) == 0 && len(in.Literals) == 0 {
+		return ConfigFile{}, fmt.Errorf("config file %s/%s must define at least one of files, env_files and literals", in.Namespace, in.Name)
+	}
+	for k := range in.Literals {
+		if errs := validation.IsConfigMapKey(k); len(errs) > 0 {
+			return ConfigFile{}, fmt.Errorf("config file %s/%s: invalid literal key (%s): %s", in.Namespace, in.Name, k, strings.Join(errs, ";"))
+		}
+	}
+	for i, item := range in.Files {
+		if item.Path == "" {
+			return ConfigFile{}, fmt.Errorf("config file %s/%s: path of files[%d] must be defined", in.Namespace, in.Name, i)
+		}
+		if item.Key == "" {
+			_, in.Files[i].Key = filepath.Split(item.Path)
+		}
+		if errs := validation.IsConfigMapKey(in.Files[i].Key); len(errs) > 0 {
+			return ConfigFile{}, fmt.Errorf("config file %s/%s: invalid key (%s) of files[%d]: %s",
+				in.Namespace, in.Name, in.Files[i].Key, i, strings.Join(errs, ";"))
+		}
+		switch item.Template {
+		case TemplateModeNone, TemplateModeGo, TemplateModeEnvsubst:
+		default:
+			return ConfigFile{}, fmt.Errorf("config file %s/%s: unsupported template mode (%s) of files[%d], please use `true`, `false` or `envsubst`",
+				in.Namespace, in.Name, item.Template, i)
+		}
+	}
+	return in, nil
 }
 
 func (c *Config) Parse(configPath string, envPrefix string) error {
@@ -151,5 +496,90 @@ func (c *Config) Parse(configPath string, envPrefix string) error {
 	}
 	return viper.Unmarshal(c, func(dc *mapstructure.DecoderConfig) {
 		dc.TagName = "json"
+		dc.DecodeHook = mapstructure.ComposeDecodeHookFunc(
+			jsonHookFunc(),
+			configFileHookFunc(),
+			templateModeHookFunc(),
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		)
 	})
 }
+
+// jsonHookFunc decodes lists and objects from JSON strings,
+// when passed through environment variables, they are JSON encoded by Drone.
+func jsonHookFunc() mapstructure.DecodeHookFuncType {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String {
+			return data, nil
+		}
+		switch t.Kind() {
+		case reflect.Slice:
+			if t.Elem().Kind() == reflect.String {
+				return data, nil
+			}
+		case reflect.Map, reflect.Struct:
+		default:
+			return data, nil
+		}
+
+		str := strings.TrimSpace(data.(string))
+		if !strings.HasPrefix(str, "[") && !strings.HasPrefix(str, "{") {
+			return data, nil
+		}
+		var out interface{}
+		if err := json.Unmarshal([]byte(str), &out); err != nil {
+			return nil, fmt.Errorf("decode %s from JSON failed: %v", t, err)
+		}
+		return out, nil
+	}
+}
+
+// configFileHookFunc decodes config_files from the legacy strings,
+// when passed through environment variables, a list of strings is joined with commas.
+func configFileHookFunc() mapstructure.DecodeHookFuncType {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String {
+			return data, nil
+		}
+		str := strings.TrimSpace(data.(string))
+
+		switch t {
+		case reflect.TypeOf([]ConfigFile{}):
+			if str == "" {
+				return []interface{}{}, nil
+			}
+			return strings.Split(str, ","), nil
+		case reflect.TypeOf(ConfigFile{}):
+			return ConfigFile{legacy: str}, nil
+		}
+		return data, nil
+	}
+}
+
+// templateModeHookFunc decodes TemplateMode from bool or string,
+// `true` means TemplateModeGo and `false` means TemplateModeNone.
+func templateModeHookFunc() mapstructure.DecodeHookFuncType {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if t != reflect.TypeOf(TemplateModeNone) {
+			return data, nil
+		}
+
+		var str string
+		switch f.Kind() {
+		case reflect.Bool:
+			str = fmt.Sprintf("%t", data)
+		case reflect.String:
+			str = strings.ToLower(strings.TrimSpace(data.(string)))
+		default:
+			return data, nil
+		}
+		switch str {
+		case "true":
+			return TemplateModeGo, nil
+		case "false":
+			return TemplateModeNone, nil
+		}
+		return TemplateMode(str), nil
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/a8m/envsubst/parse"
+	"github.com/mitchellh/mapstructure"
+)
+
+func TestConfigFileHookFunc(t *testing.T) {
+	tests := []struct {
+		name string
+		data interface{}
+		want []ConfigFile
+	}{
+		{
+			name: "empty string",
+			data: "",
+			want: []ConfigFile{},
+		},
+		{
+			name: "comma-joined legacy strings",
+			data: "ns:a:conf/a.yaml, ns:b:conf/b.yaml:b.yaml",
+			want: []ConfigFile{
+				{legacy: "ns:a:conf/a.yaml"},
+				{legacy: "ns:b:conf/b.yaml:b.yaml"},
+			},
+		},
+		{
+			name: "list of legacy strings",
+			data: []interface{}{"ns:a:conf/a.yaml"},
+			want: []ConfigFile{{legacy: "ns:a:conf/a.yaml"}},
+		},
+		{
+			name: "structured object",
+			data: []interface{}{
+				map[string]interface{}{
+					"namespace": "ns",
+					"name":      "a",
+					"files":     []interface{}{map[string]interface{}{"path": "conf/a.yaml", "key": "app.yaml"}},
+				},
+			},
+			want: []ConfigFile{{
+				Namespace: "ns",
+				Name:      "a",
+				Files:     []ConfigFileItem{{Path: "conf/a.yaml", Key: "app.yaml"}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []ConfigFile
+			decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+				TagName:    "json",
+				DecodeHook: configFileHookFunc(),
+				Result:     &got,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := decoder.Decode(tt.data); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveConfigFile(t *testing.T) {
+	parser := parse.New("string", []string{"NS=prod"}, &parse.Restrictions{})
+
+	tests := []struct {
+		name    string
+		in      ConfigFile
+		want    ConfigFile
+		wantErr bool
+	}{
+		{
+			name: "legacy without file name",
+			in:   ConfigFile{legacy: "${NS}:app:conf/app.yaml"},
+			want: ConfigFile{
+				Namespace: "prod",
+				Name:      "app",
+				Files:     []ConfigFileItem{{Path: "conf/app.yaml", Key: "app.yaml"}},
+			},
+		},
+		{
+			name: "legacy with file name",
+			in:   ConfigFile{legacy: "prod:app:conf/app.yaml:config.yaml"},
+			want: ConfigFile{
+				Namespace: "prod",
+				Name:      "app",
+				Files:     []ConfigFileItem{{Path: "conf/app.yaml", Key: "config.yaml"}},
+			},
+		},
+		{
+			name:    "legacy format error",
+			in:      ConfigFile{legacy: "prod:app"},
+			wantErr: true,
+		},
+		{
+			name: "structured",
+			in: ConfigFile{
+				Namespace: "${NS}",
+				Name:      "app",
+				Files:     []ConfigFileItem{{Path: "conf/app.yaml", Template: TemplateModeGo}},
+				EnvFiles:  []string{"conf/${NS}.env"},
+			},
+			want: ConfigFile{
+				Namespace: "prod",
+				Name:      "app",
+				Files:     []ConfigFileItem{{Path: "conf/app.yaml", Key: "app.yaml", Template: TemplateModeGo}},
+				EnvFiles:  []string{"conf/prod.env"},
+			},
+		},
+		{
+			name:    "missing name",
+			in:      ConfigFile{Namespace: "prod", Literals: map[string]string{"a": "b"}},
+			wantErr: true,
+		},
+		{
+			name:    "no data",
+			in:      ConfigFile{Namespace: "prod", Name: "app"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid literal key",
+			in:      ConfigFile{Namespace: "prod", Name: "app", Literals: map[string]string{"a/b": "c"}},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported template mode",
+			in:      ConfigFile{Namespace: "prod", Name: "app", Files: []ConfigFileItem{{Path: "a.yaml", Template: "helm"}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveConfigFile(parser, tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveConfigFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveConfigFile() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateModeHookFunc(t *testing.T) {
+	tests := []struct {
+		name string
+		data interface{}
+		want TemplateMode
+	}{
+		{name: "bool true", data: true, want: TemplateModeGo},
+		{name: "bool false", data: false, want: TemplateModeNone},
+		{name: "string true", data: "true", want: TemplateModeGo},
+		{name: "string false", data: "False", want: TemplateModeNone},
+		{name: "go", data: "go", want: TemplateModeGo},
+		{name: "envsubst", data: " envsubst ", want: TemplateModeEnvsubst},
+		{name: "empty", data: "", want: TemplateModeNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got ConfigFileItem
+			decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+				TagName:    "json",
+				DecodeHook: templateModeHookFunc(),
+				Result:     &got,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := decoder.Decode(map[string]interface{}{"template": tt.data}); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if got.Template != tt.want {
+				t.Errorf("Decode() = %q, want %q", got.Template, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	pkgruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const defaultFailureLogLines = 50
+
+// diagnoseTimeout bounds printing the diagnostics of a workload,
+// they are printed even if the run is canceled or timed out.
+const diagnoseTimeout = 30 * time.Second
+
+// diagnoseWorkload prints the events of the workload, its ReplicaSets and pods,
+// and the last lines of logs from the failing containers, grouped per pod.
+func diagnoseWorkload(ctx context.Context, kubeClient kubernetes.Interface, obj *unstructured.Unstructured, tailLines int64) {
+	namespace := obj.GetNamespace()
+	log := logrus.WithField("kind", obj.GetKind()).
+		WithField("namespace", namespace).
+		WithField("name", obj.GetName())
+
+	if events := listEvents(ctx, kubeClient, namespace, obj.GetUID()); len(events) > 0 {
+		log.Warnf("Events of %s %s:\n%s", obj.GetKind(), obj.GetName(), strings.TrimSuffix(events, "\n"))
+	}
+
+	selectorMap, found, _ := unstructured.NestedMap(obj.Object, "spec", "selector")
+	if !found {
+		return
+	}
+	var labelSelector metav1.LabelSelector
+	if err := pkgruntime.DefaultUnstructuredConverter.FromUnstructured(selectorMap, &labelSelector); err != nil {
+		log.Warnf("Parse selector failed: %v", err)
+		return
+	}
+	selector, err := metav1.LabelSelectorAsSelector(&labelSelector)
+	if err != nil {
+		log.Warnf("Parse selector failed: %v", err)
+		return
+	}
+	listOptions := metav1.ListOptions{LabelSelector: selector.String()}
+
+	if obj.GetKind() == "Deployment" {
+		rsList, err := kubeClient.AppsV1().ReplicaSets(namespace).List(ctx, listOptions)
+		if err != nil {
+			log.Warnf("List ReplicaSets failed: %v", err)
+		} else {
+			for _, rs := range rsList.Items {
+				if !metav1.IsControlledBy(&rs, obj) {
+					continue
+				}
+				if events := listEvents(ctx, kubeClient, namespace, rs.UID); len(events) > 0 {
+					log.Warnf("Events of ReplicaSet %s:\n%s", rs.Name, strings.TrimSuffix(events, "\n"))
+				}
+			}
+		}
+	}
+
+	podList, err := kubeClient.CoreV1().Pods(namespace).List(ctx, listOptions)
+	if err != nil {
+		log.Warnf("List Pods failed: %v", err)
+		return
+	}
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if isPodReady(pod) {
+			continue
+		}
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "Pod %s is %s\n", pod.Name, pod.Status.Phase)
+		if events := listEvents(ctx, kubeClient, namespace, pod.UID); len(events) > 0 {
+			fmt.Fprintf(&b, "Events:\n%s", events)
+		}
+		statuses := append(pod.Status.InitContainerStatuses[:len(pod.Status.InitContainerStatuses):len(pod.Status.InitContainerStatuses)],
+			pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if status.Ready || (status.State.Terminated != nil && status.State.Terminated.ExitCode == 0) {
+				continue
+			}
+			fmt.Fprintf(&b, "Container %s: %s\n", status.Name, containerStateString(status.State))
+			if status.RestartCount > 0 {
+				fmt.Fprintf(&b, "Logs of container %s (previous):\n%s",
+					status.Name, containerLogs(ctx, kubeClient, pod, status.Name, true, tailLines))
+			}
+			fmt.Fprintf(&b, "Logs of container %s:\n%s",
+				status.Name, containerLogs(ctx, kubeClient, pod, status.Name, false, tailLines))
+		}
+		logrus.WithField("namespace", namespace).
+			WithField("pod", pod.Name).
+			Warn(strings.TrimSuffix(b.String(), "\n"))
+	}
+}
+
+func listEvents(ctx context.Context, kubeClient kubernetes.Interface, namespace string, uid types.UID) string {
+	eventList, err := kubeClient.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("involvedObject.uid", string(uid)).String(),
+	})
+	if err != nil {
+		return fmt.Sprintf("  list events failed: %v\n", err)
+	}
+
+	events := eventList.Items
+	sort.Slice(events, func(i, j int) bool {
+		return eventTime(&events[i]).Before(eventTime(&events[j]))
+	})
+	var b strings.Builder
+	for _, event := range events {
+		fmt.Fprintf(&b, "  %s\t%s\t%s\t%s\n",
+			eventTime(&event).Format("2006/01/02 15:04:05"), event.Type, event.Reason, strings.TrimSpace(event.Message))
+	}
+	return b.String()
+}
+
+func eventTime(event *v1.Event) time.Time {
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+	if !event.EventTime.IsZero() {
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
+
+func containerLogs(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	pod *v1.Pod,
+	container string,
+	previous bool,
+	tailLines int64,
+) string {
+	b, err := kubeClient.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &v1.PodLogOptions{
+		Container: container,
+		Previous:  previous,
+		TailLines: &tailLines,
+	}).DoRaw(ctx)
+	if err != nil {
+		return fmt.Sprintf("  get logs failed: %v\n", err)
+	}
+	var out strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		out.WriteString("  " + line + "\n")
+	}
+	return out.String()
+}
+
+func containerStateString(state v1.ContainerState) string {
+	switch {
+	case state.Waiting != nil:
+		return fmt.Sprintf("waiting, reason: %s, message: %s", state.Waiting.Reason, state.Waiting.Message)
+	case state.Terminated != nil:
+		return fmt.Sprintf("terminated with exit code %d, reason: %s, message: %s",
+			state.Terminated.ExitCode, state.Terminated.Reason, state.Terminated.Message)
+	case state.Running != nil:
+		return "running, not ready"
+	}
+	return "unknown"
+}
+
+func isPodReady(pod *v1.Pod) bool {
+	if pod.Status.Phase == v1.PodSucceeded {
+		return true
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestIsPodReady(t *testing.T) {
+	tests := []struct {
+		name string
+		pod  v1.PodStatus
+		want bool
+	}{
+		{
+			name: "ready",
+			pod: v1.PodStatus{Phase: v1.PodRunning, Conditions: []v1.PodCondition{
+				{Type: v1.PodScheduled, Status: v1.ConditionTrue},
+				{Type: v1.PodReady, Status: v1.ConditionTrue},
+			}},
+			want: true,
+		},
+		{
+			name: "not ready",
+			pod: v1.PodStatus{Phase: v1.PodRunning, Conditions: []v1.PodCondition{
+				{Type: v1.PodReady, Status: v1.ConditionFalse},
+			}},
+		},
+		{
+			name: "without ready condition",
+			pod:  v1.PodStatus{Phase: v1.PodPending},
+		},
+		{
+			name: "succeeded",
+			pod:  v1.PodStatus{Phase: v1.PodSucceeded},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPodReady(&v1.Pod{Status: tt.pod}); got != tt.want {
+				t.Errorf("isPodReady() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerStateString(t *testing.T) {
+	tests := []struct {
+		name  string
+		state v1.ContainerState
+		want  string
+	}{
+		{
+			name:  "waiting",
+			state: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "pull failed"}},
+			want:  "waiting, reason: ImagePullBackOff, message: pull failed",
+		},
+		{
+			name:  "terminated",
+			state: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 137, Reason: "OOMKilled"}},
+			want:  "terminated with exit code 137, reason: OOMKilled, message: ",
+		},
+		{
+			name:  "running",
+			state: v1.ContainerState{Running: &v1.ContainerStateRunning{}},
+			want:  "running, not ready",
+		},
+		{
+			name: "unknown",
+			want: "unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := containerStateString(tt.state); got != tt.want {
+				t.Errorf("containerStateString() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListEvents(t *testing.T) {
+	base := time.Date(2022, 10, 1, 8, 0, 0, 0, time.Local)
+	newEvent := func(name, reason string, fn func(event *v1.Event)) *v1.Event {
+		event := &v1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: name, Namespace: "default"},
+			InvolvedObject: v1.ObjectReference{UID: "uid"},
+			Type:           v1.EventTypeWarning,
+			Reason:         reason,
+			Message:        reason + " message\n",
+		}
+		fn(event)
+		return event
+	}
+	kubeClient := fake.NewSimpleClientset(
+		newEvent("a", "Third", func(event *v1.Event) {
+			event.LastTimestamp = metav1.NewTime(base.Add(3 * time.Minute))
+		}),
+		newEvent("b", "First", func(event *v1.Event) {
+			event.CreationTimestamp = metav1.NewTime(base.Add(time.Minute))
+		}),
+		newEvent("c", "Second", func(event *v1.Event) {
+			event.EventTime = metav1.NewMicroTime(base.Add(2 * time.Minute))
+		}),
+	)
+
+	got := listEvents(context.Background(), kubeClient, "default", "uid")
+	want := strings.Join([]string{
+		"  2022/10/01 08:01:00\tWarning\tFirst\tFirst message",
+		"  2022/10/01 08:02:00\tWarning\tSecond\tSecond message",
+		"  2022/10/01 08:03:00\tWarning\tThird\tThird message",
+	}, "\n") + "\n"
+	if got != want {
+		t.Errorf("listEvents() = %q, want %q", got, want)
+	}
+
+	if got := listEvents(context.Background(), fake.NewSimpleClientset(), "default", "uid"); got != "" {
+		t.Errorf("listEvents() without events = %q, want empty", got)
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	pkgruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/constants"
+	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+)
+
+type HookPhase string
+
+const (
+	// HookPreApply runs before applying the templates.
+	HookPreApply HookPhase = "pre-apply"
+	// HookPostApply runs after the templates are applied and ready.
+	HookPostApply HookPhase = "post-apply"
+	// HookOnFailure runs when the run fails.
+	HookOnFailure HookPhase = "on-failure"
+)
+
+const (
+	// HookDeleteBeforeCreation deletes the previous hook object before a new one is created, it is the default policy.
+	HookDeleteBeforeCreation = "before-hook-creation"
+	// HookDeleteSucceeded deletes the hook object after the hook succeeded.
+	HookDeleteSucceeded = "hook-succeeded"
+	// HookDeleteFailed deletes the hook object after the hook failed.
+	HookDeleteFailed = "hook-failed"
+)
+
+type hookSet map[HookPhase][]unstructured.Unstructured
+
+// extractHooks removes the hook objects from the object sets, and groups them by phase.
+func extractHooks(objSets ...*[][]unstructured.Unstructured) (hookSet, error) {
+	hooks := make(hookSet)
+	for _, objSet := range objSets {
+		for i, objs := range *objSet {
+			current := make([]unstructured.Unstructured, 0, len(objs))
+			for _, obj := range objs {
+				phase, ok := obj.GetAnnotations()[constants.AnnotationHook]
+				if !ok {
+					current = append(current, obj)
+					continue
+				}
+
+				switch HookPhase(phase) {
+				case HookPreApply, HookPostApply, HookOnFailure:
+				default:
+					return nil, fmt.Errorf("unsupported hook phase (%s) of %s %s, please use `%s`, `%s` or `%s`",
+						phase, obj.GetKind(), obj.GetName(), HookPreApply, HookPostApply, HookOnFailure)
+				}
+				if obj.GetKind() != "Job" && obj.GetKind() != "Pod" {
+					return nil, fmt.Errorf("unsupported hook kind (%s) of %s, only Job and Pod are supported", obj.GetKind(), obj.GetName())
+				}
+				for _, policy := range hookDeletePolicies(&obj) {
+					switch policy {
+					case HookDeleteBeforeCreation, HookDeleteSucceeded, HookDeleteFailed:
+					default:
+						return nil, fmt.Errorf("unsupported hook delete policy (%s) of %s %s", policy, obj.GetKind(), obj.GetName())
+					}
+				}
+				hooks[HookPhase(phase)] = append(hooks[HookPhase(phase)], obj)
+			}
+			(*objSet)[i] = current
+		}
+	}
+	return hooks, nil
+}
+
+func hookDeletePolicies(obj *unstructured.Unstructured) []string {
+	value, ok := obj.GetAnnotations()[constants.AnnotationHookDeletePolicy]
+	if !ok {
+		return []string{HookDeleteBeforeCreation}
+	}
+	var policies []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			policies = append(policies, v)
+		}
+	}
+	return policies
+}
+
+// runHooks runs the hooks of the phase in order, and stops at the first failed hook.
+func runHooks(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	hooks hookSet,
+	phase HookPhase,
+	cfg *Config,
+	report *Report,
+) error {
+	for _, hook := range hooks[phase] {
+		obj := hook.DeepCopy()
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(cfg.Namespace)
+		}
+
+		start := time.Now()
+		err := runHook(ctx, kubeClient, dynamicClient, mapping, obj, phase, cfg.WaitTimeout, cfg.RequestTimeout)
+		report.AddHook(obj, phase, start, err)
+		if err != nil {
+			return fmt.Errorf("%s hook %s %s failed: %v", phase, obj.GetKind(), obj.GetName(), err)
+		}
+	}
+	return nil
+}
+
+func runHook(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	obj *unstructured.Unstructured,
+	phase HookPhase,
+	timeout time.Duration,
+	requestTimeout time.Duration,
+) error {
+	resourceInter, _, err := newResourceInterface(dynamicClient, mapping, obj.GroupVersionKind(), obj.GetNamespace())
+	if err != nil {
+		return err
+	}
+	policies := hookDeletePolicies(obj)
+	hasPolicy := func(policy string) bool {
+		for _, v := range policies {
+			if v == policy {
+				return true
+			}
+		}
+		return false
+	}
+
+	if obj.GetName() != "" && hasPolicy(HookDeleteBeforeCreation) {
+		if err := deleteAndWait(ctx, resourceInter, obj.GetName(), metav1.DeletePropagationBackground, timeout, requestTimeout); err != nil {
+			return err
+		}
+	}
+
+	logrus.WithField("phase", phase).
+		WithField("kind", obj.GetKind()).
+		WithField("namespace", obj.GetNamespace()).
+		WithField("name", obj.GetName()).
+		Info("Run Hook")
+	var created *unstructured.Unstructured
+	err = callWithTimeout(ctx, requestTimeout, func(ctx context.Context) error {
+		var err error
+		created, err = resourceInter.Create(ctx, obj, metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	obj.SetName(created.GetName())
+
+	hookErr := waitHook(ctx, kubeClient, resourceInter, created, timeout, requestTimeout)
+	if (hookErr == nil && hasPolicy(HookDeleteSucceeded)) || (hookErr != nil && hasPolicy(HookDeleteFailed)) {
+		if err := deleteAndWait(ctx, resourceInter, created.GetName(), metav1.DeletePropagationBackground, timeout, requestTimeout); err != nil {
+			logrus.Warnf("Delete hook %s %s failed: %v", created.GetKind(), created.GetName(), err)
+		}
+	}
+	return hookErr
+}
+
+// waitHook waits until the hook Job or Pod is completed, and streams the logs of its containers,
+// each request except following the logs is bounded by requestTimeout.
+func waitHook(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	resourceInter dynamic.ResourceInterface,
+	obj *unstructured.Unstructured,
+	timeout time.Duration,
+	requestTimeout time.Duration,
+) error {
+	streamer := newLogStreamer(ctx, kubeClient, obj.GetName())
+	defer streamer.Close()
+
+	selector := "job-name=" + obj.GetName()
+	if uid, ok, _ := unstructured.NestedString(obj.Object, "spec", "selector", "matchLabels", "controller-uid"); ok {
+		selector = "controller-uid=" + uid
+	}
+
+	var hookErr error
+	err := wait.PollImmediateWithContext(ctx, waitInterval, timeout, func(ctx context.Context) (bool, error) {
+		current, err := getWithTimeout(ctx, resourceInter, obj.GetName(), requestTimeout)
+		if err != nil {
+			return false, err
+		}
+
+		switch current.GetKind() {
+		case "Pod":
+			var pod v1.Pod
+			if err := pkgruntime.DefaultUnstructuredConverter.FromUnstructured(current.Object, &pod); err != nil {
+				return false, err
+			}
+			streamer.Stream(&pod)
+			switch pod.Status.Phase {
+			case v1.PodSucceeded:
+				return true, nil
+			case v1.PodFailed:
+				hookErr = fmt.Errorf("pod failed: %s", pod.Status.Message)
+				return true, nil
+			}
+		case "Job":
+			var podList *v1.PodList
+			err := callWithTimeout(ctx, requestTimeout, func(ctx context.Context) error {
+				var err error
+				podList, err = kubeClient.CoreV1().Pods(current.GetNamespace()).List(ctx, metav1.ListOptions{LabelSelector: selector})
+				return err
+			})
+			if err != nil {
+				return false, err
+			}
+			for i := range podList.Items {
+				streamer.Stream(&podList.Items[i])
+			}
+			if condition, ok := kube.FindCondition(current, "Complete"); ok && condition.Status == "True" {
+				return true, nil
+			}
+			if condition, ok := kube.FindCondition(current, "Failed"); ok && condition.Status == "True" {
+				hookErr = fmt.Errorf("job failed, reason: %s, message: %s", condition.Reason, condition.Message)
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("not completed after %s", timeout)
+	}
+	if err != nil {
+		return err
+	}
+	return hookErr
+}
+
+// deleteAndWait deletes the object and waits until it is gone,
+// waiting is bounded by timeout, and each request is bounded by requestTimeout.
+func deleteAndWait(
+	ctx context.Context,
+	resourceInter dynamic.ResourceInterface,
+	name string,
+	propagation metav1.DeletionPropagation,
+	timeout time.Duration,
+	requestTimeout time.Duration,
+) error {
+	err := callWithTimeout(ctx, requestTimeout, func(ctx context.Context) error {
+		return resourceInter.Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("delete %s failed: %v", name, err)
+	}
+	err = wait.PollImmediateWithContext(ctx, waitInterval, timeout, func(ctx context.Context) (bool, error) {
+		_, err := getWithTimeout(ctx, resourceInter, name, requestTimeout)
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err == wait.ErrWaitTimeout && ctx.Err() != nil {
+		return fmt.Errorf("wait for %s to be deleted failed: %v", name, ctx.Err())
+	}
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("wait for %s to be deleted timeout after %s", name, timeout)
+	}
+	return err
+}
+
+// logStreamCloseTimeout is the time to wait for the remaining logs after the hook is completed.
+const logStreamCloseTimeout = 10 * time.Second
+
+// logStreamer follows the logs of containers once they are started.
+type logStreamer struct {
+	kubeClient kubernetes.Interface
+	hook       string
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	streamed map[string]struct{}
+}
+
+func newLogStreamer(ctx context.Context, kubeClient kubernetes.Interface, hook string) *logStreamer {
+	ctx, cancel := context.WithCancel(ctx)
+	return &logStreamer{
+		kubeClient: kubeClient,
+		hook:       hook,
+		ctx:        ctx,
+		cancel:     cancel,
+		streamed:   make(map[string]struct{}),
+	}
+}
+
+// Stream starts to follow the logs of the started containers in the pod which are not followed yet.
+func (s *logStreamer) Stream(pod *v1.Pod) {
+	statuses := append(pod.Status.InitContainerStatuses[:len(pod.Status.InitContainerStatuses):len(pod.Status.InitContainerStatuses)],
+		pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if status.State.Running == nil && status.State.Terminated == nil {
+			continue
+		}
+
+		key := pod.Name + "/" + status.Name
+		s.mu.Lock()
+		_, ok := s.streamed[key]
+		s.streamed[key] = struct{}{}
+		s.mu.Unlock()
+		if ok {
+			continue
+		}
+
+		s.wg.Add(1)
+		go func(namespace, name, container string) {
+			defer s.wg.Done()
+			s.follow(namespace, name, container)
+		}(pod.Namespace, pod.Name, status.Name)
+	}
+}
+
+func (s *logStreamer) follow(namespace, pod, container string) {
+	log := logrus.WithField("hook", s.hook).
+		WithField("pod", pod).
+		WithField("container", container)
+
+	stream, err := s.kubeClient.CoreV1().Pods(namespace).GetLogs(pod, &v1.PodLogOptions{
+		Container: container,
+		Follow:    true,
+	}).Stream(s.ctx)
+	if err != nil {
+		log.Warnf("Stream logs failed: %v", err)
+		return
+	}
+	defer stream.Close()
+
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		log.Info(scanner.Text())
+	}
+}
+
+// Close waits until all the logs are followed to the end,
+// and stops following if it takes longer than logStreamCloseTimeout.
+func (s *logStreamer) Close() {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(logStreamCloseTimeout):
+	}
+	s.cancel()
+	<-done
+}
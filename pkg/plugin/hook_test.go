@@ -0,0 +1,241 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	pkgruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/constants"
+)
+
+func newHookObject(kind, name string, annotations map[string]string) unstructured.Unstructured {
+	obj := unstructured.Unstructured{Object: map[string]interface{}{}}
+	obj.SetAPIVersion("v1")
+	if kind == "Job" {
+		obj.SetAPIVersion("batch/v1")
+	}
+	obj.SetKind(kind)
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetAnnotations(annotations)
+	return obj
+}
+
+func TestExtractHooks(t *testing.T) {
+	hook := func(phase string) map[string]string {
+		return map[string]string{constants.AnnotationHook: phase}
+	}
+
+	tests := []struct {
+		name      string
+		objs      []unstructured.Unstructured
+		wantHooks map[HookPhase][]string
+		wantObjs  []string
+		wantErr   bool
+	}{
+		{
+			name: "hooks grouped by phase",
+			objs: []unstructured.Unstructured{
+				newHookObject("ConfigMap", "app", nil),
+				newHookObject("Job", "migrate", hook("pre-apply")),
+				newHookObject("Pod", "smoke", hook("post-apply")),
+				newHookObject("Job", "notify", hook("on-failure")),
+				newHookObject("Job", "seed", hook("pre-apply")),
+			},
+			wantHooks: map[HookPhase][]string{
+				HookPreApply:  {"migrate", "seed"},
+				HookPostApply: {"smoke"},
+				HookOnFailure: {"notify"},
+			},
+			wantObjs: []string{"app"},
+		},
+		{
+			name: "delete policies",
+			objs: []unstructured.Unstructured{
+				newHookObject("Job", "migrate", map[string]string{
+					constants.AnnotationHook:             "pre-apply",
+					constants.AnnotationHookDeletePolicy: "before-hook-creation, hook-succeeded,hook-failed",
+				}),
+			},
+			wantHooks: map[HookPhase][]string{HookPreApply: {"migrate"}},
+			wantObjs:  []string{},
+		},
+		{
+			name:    "bad phase",
+			objs:    []unstructured.Unstructured{newHookObject("Job", "migrate", hook("post-install"))},
+			wantErr: true,
+		},
+		{
+			name:    "bad kind",
+			objs:    []unstructured.Unstructured{newHookObject("Deployment", "migrate", hook("pre-apply"))},
+			wantErr: true,
+		},
+		{
+			name: "bad delete policy",
+			objs: []unstructured.Unstructured{
+				newHookObject("Job", "migrate", map[string]string{
+					constants.AnnotationHook:             "pre-apply",
+					constants.AnnotationHookDeletePolicy: "hook-succeeded,always",
+				}),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objSet := [][]unstructured.Unstructured{tt.objs}
+			hooks, err := extractHooks(&objSet)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractHooks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			gotHooks := make(map[HookPhase][]string)
+			for phase, objs := range hooks {
+				for _, obj := range objs {
+					gotHooks[phase] = append(gotHooks[phase], obj.GetName())
+				}
+			}
+			if !reflect.DeepEqual(gotHooks, tt.wantHooks) {
+				t.Errorf("extractHooks() hooks = %v, want %v", gotHooks, tt.wantHooks)
+			}
+			gotObjs := make([]string, 0)
+			for _, obj := range objSet[0] {
+				gotObjs = append(gotObjs, obj.GetName())
+			}
+			if !reflect.DeepEqual(gotObjs, tt.wantObjs) {
+				t.Errorf("extractHooks() objects = %v, want %v", gotObjs, tt.wantObjs)
+			}
+		})
+	}
+}
+
+func TestRunHook(t *testing.T) {
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	mapping := meta.NewDefaultRESTMapper(nil)
+	mapping.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, meta.RESTScopeNamespace)
+
+	newPod := func(phase, policy string) *unstructured.Unstructured {
+		annotations := map[string]string{constants.AnnotationHook: string(HookPreApply)}
+		if policy != "" {
+			annotations[constants.AnnotationHookDeletePolicy] = policy
+		}
+		obj := newHookObject("Pod", "migrate", annotations)
+		_ = unstructured.SetNestedField(obj.Object, phase, "status", "phase")
+		return &obj
+	}
+
+	tests := []struct {
+		name       string
+		obj        *unstructured.Unstructured
+		live       bool
+		wantErr    bool
+		wantExists bool
+	}{
+		{
+			name:       "succeeded and kept by default",
+			obj:        newPod("Succeeded", ""),
+			wantExists: true,
+		},
+		{
+			name: "succeeded and deleted",
+			obj:  newPod("Succeeded", HookDeleteSucceeded),
+		},
+		{
+			name:       "failed and kept",
+			obj:        newPod("Failed", HookDeleteSucceeded),
+			wantErr:    true,
+			wantExists: true,
+		},
+		{
+			name:    "failed and deleted",
+			obj:     newPod("Failed", HookDeleteFailed),
+			wantErr: true,
+		},
+		{
+			name:       "previous hook deleted before creation",
+			obj:        newPod("Succeeded", HookDeleteBeforeCreation),
+			live:       true,
+			wantExists: true,
+		},
+		{
+			name:       "previous hook kept",
+			obj:        newPod("Succeeded", HookDeleteSucceeded),
+			live:       true,
+			wantErr:    true,
+			wantExists: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objs []pkgruntime.Object
+			if tt.live {
+				objs = append(objs, newPod("Running", "").DeepCopy())
+			}
+			dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(pkgruntime.NewScheme(),
+				map[schema.GroupVersionResource]string{gvr: "PodList"}, objs...)
+
+			err := runHook(context.Background(), fake.NewSimpleClientset(), dynamicClient, mapping,
+				tt.obj.DeepCopy(), HookPreApply, time.Second, time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runHook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			live, err := dynamicClient.Resource(gvr).Namespace("default").Get(context.Background(), "migrate", metav1.GetOptions{})
+			if exists := err == nil; exists != tt.wantExists {
+				t.Fatalf("hook exists = %v, want %v, error = %v", exists, tt.wantExists, err)
+			}
+			if err != nil && !apierrors.IsNotFound(err) {
+				t.Fatal(err)
+			}
+			if tt.live && tt.wantExists && !tt.wantErr {
+				if phase, _, _ := unstructured.NestedString(live.Object, "status", "phase"); phase != "Succeeded" {
+					t.Errorf("hook phase = %s, want the new hook created", phase)
+				}
+			}
+		})
+	}
+}
+
+func TestWaitReadiness_SkipHooks(t *testing.T) {
+	job := newHookObject("Job", "migrate", nil)
+	report := NewReport(nil)
+	report.AddHook(&job, HookPreApply, time.Now(), nil)
+
+	cfg := &Config{
+		Readiness:   []ReadinessRule{{Kind: "Job", ConditionType: "Complete", ConditionStatus: "True"}},
+		WaitTimeout: time.Second,
+	}
+	// the hook Job is deleted, it would fail the readiness check if it was waited
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(pkgruntime.NewScheme())
+	err := waitReadiness(context.Background(), fake.NewSimpleClientset(), dynamicClient, meta.NewDefaultRESTMapper(nil), report, cfg)
+	if err != nil {
+		t.Errorf("waitReadiness() error = %v, want the hook skipped", err)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+)
+
+// ImageOverride replaces the images matching Name, like the images of kustomize.
+type ImageOverride struct {
+	Name    string
+	NewName string
+	NewTag  string
+	Digest  string
+}
+
+// parseImageOverride parses the override definition,
+// supports `name=newName`, `name=newName:tag`, `name=newName@digest`, `name:tag` and `name@digest`.
+func parseImageOverride(s string) (ImageOverride, error) {
+	s = strings.TrimSpace(s)
+	override := ImageOverride{}
+	if name, value, ok := strings.Cut(s, "="); ok {
+		override.Name = name
+		override.NewName, override.NewTag, override.Digest = splitImage(value)
+	} else {
+		override.Name, override.NewTag, override.Digest = splitImage(s)
+		if override.NewTag == "" && override.Digest == "" {
+			return override, fmt.Errorf("image override (%s) must define a new name, tag or digest", s)
+		}
+	}
+	if override.Name == "" {
+		return override, fmt.Errorf("image override (%s) must define the image name", s)
+	}
+	return override, nil
+}
+
+// splitImage splits the image into name, tag and digest.
+func splitImage(image string) (string, string, string) {
+	var digest, tag string
+	if i := strings.Index(image, "@"); i >= 0 {
+		image, digest = image[:i], image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image, tag = image[:i], image[i+1:]
+	}
+	return image, tag, digest
+}
+
+// Apply returns the image replaced by the override, and whether the image matches.
+func (o *ImageOverride) Apply(image string) (string, bool) {
+	name, tag, digest := splitImage(image)
+	if name != o.Name {
+		return image, false
+	}
+
+	if o.NewName != "" {
+		name = o.NewName
+	}
+	switch {
+	case o.Digest != "":
+		return name + "@" + o.Digest, true
+	case o.NewTag != "":
+		return name + ":" + o.NewTag, true
+	case digest != "":
+		return name + "@" + digest, true
+	case tag != "":
+		return name + ":" + tag, true
+	}
+	return name, true
+}
+
+// ImageReplacement records an image replaced by the overrides.
+type ImageReplacement struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Container string `json:"container"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+}
+
+// overrideImages replaces the container images of workloads in the object sets,
+// an error is returned if any override matches nothing.
+func overrideImages(overrides []ImageOverride, objSets ...[][]unstructured.Unstructured) ([]ImageReplacement, error) {
+	if len(overrides) == 0 {
+		return nil, nil
+	}
+
+	matched := make([]bool, len(overrides))
+	var replacements []ImageReplacement
+	for _, objSet := range objSets {
+		for _, objs := range objSet {
+			for i := range objs {
+				obj := &objs[i]
+				err := kube.VisitContainers(obj, func(container map[string]interface{}) error {
+					image, _ := container["image"].(string)
+					for j := range overrides {
+						current, ok := overrides[j].Apply(image)
+						if !ok {
+							continue
+						}
+						matched[j] = true
+						if current == image {
+							return nil
+						}
+
+						name, _ := container["name"].(string)
+						replacement := ImageReplacement{
+							Kind:      obj.GetKind(),
+							Namespace: obj.GetNamespace(),
+							Name:      obj.GetName(),
+							Container: name,
+							From:      image,
+							To:        current,
+						}
+						logrus.WithField("kind", replacement.Kind).
+							WithField("name", replacement.Name).
+							WithField("container", replacement.Container).
+							Infof("Replace image %s with %s", image, current)
+						container["image"] = current
+						replacements = append(replacements, replacement)
+						return nil
+					}
+					return nil
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	var unmatched []string
+	for i, ok := range matched {
+		if !ok {
+			unmatched = append(unmatched, overrides[i].Name)
+		}
+	}
+	if len(unmatched) > 0 {
+		return nil, errors.New("image overrides matched nothing: " + strings.Join(unmatched, ", "))
+	}
+	return replacements, nil
+}
@@ -0,0 +1,127 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestSplitImage(t *testing.T) {
+	tests := []struct {
+		image      string
+		wantName   string
+		wantTag    string
+		wantDigest string
+	}{
+		{image: "nginx", wantName: "nginx"},
+		{image: "nginx:1.23", wantName: "nginx", wantTag: "1.23"},
+		{image: "nginx@" + testDigest, wantName: "nginx", wantDigest: testDigest},
+		{image: "nginx:1.23@" + testDigest, wantName: "nginx", wantTag: "1.23", wantDigest: testDigest},
+		{image: "localhost:5000/nginx", wantName: "localhost:5000/nginx"},
+		{image: "localhost:5000/library/nginx:1.23", wantName: "localhost:5000/library/nginx", wantTag: "1.23"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			name, tag, digest := splitImage(tt.image)
+			if name != tt.wantName || tag != tt.wantTag || digest != tt.wantDigest {
+				t.Errorf("splitImage() = (%s, %s, %s), want (%s, %s, %s)",
+					name, tag, digest, tt.wantName, tt.wantTag, tt.wantDigest)
+			}
+		})
+	}
+}
+
+func TestParseImageOverride(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ImageOverride
+		wantErr bool
+	}{
+		{in: "nginx:1.23", want: ImageOverride{Name: "nginx", NewTag: "1.23"}},
+		{in: " nginx@" + testDigest + " ", want: ImageOverride{Name: "nginx", Digest: testDigest}},
+		{in: "nginx=registry.example.com/nginx", want: ImageOverride{Name: "nginx", NewName: "registry.example.com/nginx"}},
+		{in: "nginx=registry.example.com:5000/nginx:1.23", want: ImageOverride{Name: "nginx", NewName: "registry.example.com:5000/nginx", NewTag: "1.23"}},
+		{in: "nginx=registry.example.com/nginx@" + testDigest, want: ImageOverride{Name: "nginx", NewName: "registry.example.com/nginx", Digest: testDigest}},
+		{in: "nginx", wantErr: true},
+		{in: "=nginx:1.23", wantErr: true},
+		{in: ":1.23", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseImageOverride(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseImageOverride() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseImageOverride() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageOverride_Apply(t *testing.T) {
+	tests := []struct {
+		name      string
+		override  ImageOverride
+		image     string
+		want      string
+		wantMatch bool
+	}{
+		{
+			name:     "not matched",
+			override: ImageOverride{Name: "nginx", NewTag: "1.23"},
+			image:    "redis:7",
+			want:     "redis:7",
+		},
+		{
+			name:      "new tag",
+			override:  ImageOverride{Name: "nginx", NewTag: "1.23"},
+			image:     "nginx:1.22",
+			want:      "nginx:1.23",
+			wantMatch: true,
+		},
+		{
+			name:      "digest takes precedence",
+			override:  ImageOverride{Name: "nginx", NewTag: "1.23", Digest: testDigest},
+			image:     "nginx",
+			want:      "nginx@" + testDigest,
+			wantMatch: true,
+		},
+		{
+			name:      "new name keeps tag",
+			override:  ImageOverride{Name: "nginx", NewName: "registry.example.com/nginx"},
+			image:     "nginx:1.22",
+			want:      "registry.example.com/nginx:1.22",
+			wantMatch: true,
+		},
+		{
+			name:      "new name keeps digest",
+			override:  ImageOverride{Name: "nginx", NewName: "registry.example.com/nginx"},
+			image:     "nginx@" + testDigest,
+			want:      "registry.example.com/nginx@" + testDigest,
+			wantMatch: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.override.Apply(tt.image)
+			if got != tt.want || ok != tt.wantMatch {
+				t.Errorf("Apply() = (%s, %v), want (%s, %v)", got, ok, tt.want, tt.wantMatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+	"github.com/zc2638/drone-k8s-plugin/pkg/redact"
+	"github.com/zc2638/drone-k8s-plugin/pkg/tpl"
+)
+
+// renderFileSystem renders the yaml files and kustomization files with tpl.Render when reading them.
+type renderFileSystem struct {
+	filesys.FileSystem
+	envMap map[string]string
+}
+
+func (fs *renderFileSystem) ReadFile(path string) ([]byte, error) {
+	data, err := fs.FileSystem.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch ext := filepath.Ext(path); {
+	case ext == ".yaml", ext == ".yml", filepath.Base(path) == "Kustomization":
+	default:
+		return data, nil
+	}
+	rendered, err := tpl.Render(data, fs.envMap)
+	if err != nil {
+		return nil, fmt.Errorf("render file(%s) failed: %v", path, err)
+	}
+	return rendered, nil
+}
+
+// buildKustomizations builds the kustomization directories in-process,
+// the objects of each directory are a set in the result.
+func buildKustomizations(
+	dirs []string,
+	render bool,
+	envMap map[string]string,
+	redactor *redact.Redactor,
+) ([][]unstructured.Unstructured, error) {
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+
+	var fs filesys.FileSystem = filesys.MakeFsOnDisk()
+	if render {
+		fs = &renderFileSystem{FileSystem: fs, envMap: envMap}
+	}
+	kustomizer := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+
+	objSet := make([][]unstructured.Unstructured, 0, len(dirs))
+	for _, dir := range dirs {
+		resMap, err := kustomizer.Run(fs, dir)
+		if err != nil {
+			return nil, fmt.Errorf("build kustomization(%s) failed: %v", dir, err)
+		}
+		data, err := resMap.AsYaml()
+		if err != nil {
+			return nil, fmt.Errorf("encode kustomization(%s) failed: %v", dir, err)
+		}
+		objs, err := kube.ParseObject(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse kustomization(%s) failed: %v", dir, err)
+		}
+		redactSecrets(redactor, objs)
+		logrus.Debugf("Built kustomization(%s):\n%s", dir, data)
+		objSet = append(objSet, objs)
+	}
+	return objSet, nil
+}
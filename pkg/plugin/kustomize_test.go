@@ -0,0 +1,138 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/redact"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRenderFileSystem(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app.yaml":       "name: {{ .env.NAME }}",
+		"app.yml":        "name: {{ .env.NAME }}",
+		"Kustomization":  "namePrefix: {{ .env.NAME }}-",
+		"app.properties": "name={{ .env.NAME }}",
+		"app.txt":        "name: {{ .env.NAME }}",
+	})
+	fs := &renderFileSystem{FileSystem: filesys.MakeFsOnDisk(), envMap: map[string]string{"NAME": "app"}}
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{file: "app.yaml", want: "name: app"},
+		{file: "app.yml", want: "name: app"},
+		{file: "Kustomization", want: "namePrefix: app-"},
+		{file: "app.properties", want: "name={{ .env.NAME }}"},
+		{file: "app.txt", want: "name: {{ .env.NAME }}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got, err := fs.ReadFile(filepath.Join(dir, tt.file))
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ReadFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	writeFiles(t, dir, map[string]string{"invalid.yaml": "name: {{ .env.NAME"})
+	if _, err := fs.ReadFile(filepath.Join(dir, "invalid.yaml")); err == nil {
+		t.Error("ReadFile() of an invalid template error = nil, want error")
+	}
+}
+
+func TestBuildKustomizations(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"base/kustomization.yaml": "resources:\n- configmap.yaml\n",
+		"base/configmap.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  env: "{{ .env.ENV }}"
+`,
+		"overlay/kustomization.yaml": `resources:
+- ../base
+configMapGenerator:
+- name: props
+  options:
+    disableNameSuffixHash: true
+  files:
+  - app.properties
+`,
+		"overlay/app.properties": "env={{ .env.ENV }}",
+	})
+	envMap := map[string]string{"ENV": "prod"}
+
+	tests := []struct {
+		name    string
+		render  bool
+		wantEnv string
+	}{
+		{name: "without template", render: false, wantEnv: "{{ .env.ENV }}"},
+		{name: "with template", render: true, wantEnv: "prod"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objSet, err := buildKustomizations([]string{filepath.Join(dir, "overlay")}, tt.render, envMap, redact.New())
+			if err != nil {
+				t.Fatalf("buildKustomizations() error = %v", err)
+			}
+			if len(objSet) != 1 || len(objSet[0]) != 2 {
+				t.Fatalf("buildKustomizations() = %v, want 1 set of 2 objects", objSet)
+			}
+
+			data := make(map[string]map[string]interface{})
+			for _, obj := range objSet[0] {
+				data[obj.GetName()], _ = obj.Object["data"].(map[string]interface{})
+			}
+			if got := data["app"]["env"]; got != tt.wantEnv {
+				t.Errorf("env of the yaml file = %v, want %s", got, tt.wantEnv)
+			}
+			// the files of generators are not rendered
+			if got, want := data["props"]["app.properties"], "env={{ .env.ENV }}"; got != want {
+				t.Errorf("generated file = %v, want %s", got, want)
+			}
+		})
+	}
+
+	if _, err := buildKustomizations([]string{filepath.Join(dir, "missing")}, false, envMap, redact.New()); err == nil {
+		t.Error("buildKustomizations() of a missing directory error = nil, want error")
+	}
+}
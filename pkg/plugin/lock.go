@@ -0,0 +1,317 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	coordinationclientv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+const (
+	defaultLockTimeout       = 10 * time.Minute
+	defaultLockLeaseDuration = time.Minute
+)
+
+// Lock defines the Lease acquired before applying,
+// to avoid concurrent runs for the same app interleaving updates.
+type Lock struct {
+	// Key is the name of the Lease, the lock is disabled if it is empty.
+	Key string `json:"key"`
+	// Namespace is the namespace of the Lease, defaults to `namespace`.
+	Namespace string `json:"namespace"`
+	// Wait waits for the lock when it is held by another holder, otherwise fails fast.
+	Wait bool `json:"wait"`
+	// Timeout is the max time to wait for the lock, defaults to 10m.
+	Timeout time.Duration `json:"timeout"`
+	// LeaseDuration is the duration that the lock is held without renewing, defaults to 1m.
+	LeaseDuration time.Duration `json:"lease_duration"`
+}
+
+type leaseLock struct {
+	client   coordinationclientv1.LeaseInterface
+	name     string
+	identity string
+	duration time.Duration
+	// timeout bounds each request to the Lease.
+	timeout time.Duration
+
+	// cancel cancels the context of the run when the lock is lost.
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	err      error
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// lockIdentity identifies the current run as the holder of the lock.
+func lockIdentity(envMap map[string]string) string {
+	hostname, _ := os.Hostname()
+	if repo, build := envMap["DRONE_REPO"], envMap["DRONE_BUILD_NUMBER"]; repo != "" && build != "" {
+		return fmt.Sprintf("%s#%s (%s)", repo, build, hostname)
+	}
+	return hostname
+}
+
+// acquireLock acquires the Lease and keeps renewing it until released.
+// The returned context is canceled when the lock is lost, the run should stop with the error of Err.
+// Each request to the Lease is bounded by requestTimeout.
+func acquireLock(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	lock *Lock,
+	identity string,
+	requestTimeout time.Duration,
+) (*leaseLock, context.Context, error) {
+	l := &leaseLock{
+		client:   kubeClient.CoordinationV1().Leases(lock.Namespace),
+		name:     lock.Key,
+		identity: identity,
+		duration: lock.LeaseDuration,
+		timeout:  requestTimeout,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	log := logrus.WithField("namespace", lock.Namespace).WithField("name", lock.Key)
+
+	var holder string
+	err := wait.PollImmediateWithContext(ctx, waitInterval, lock.Timeout, func(ctx context.Context) (bool, error) {
+		current, err := l.tryAcquire(ctx)
+		if err != nil {
+			return false, err
+		}
+		if current == l.identity {
+			return true, nil
+		}
+		if !lock.Wait {
+			return false, fmt.Errorf("lock %s/%s is held by %s", lock.Namespace, lock.Key, current)
+		}
+		if current != holder {
+			log.Infof("Wait for the lock held by %s", current)
+		}
+		holder = current
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return nil, nil, fmt.Errorf("wait for lock %s/%s held by %s timeout after %s", lock.Namespace, lock.Key, holder, lock.Timeout)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Info("Lock acquired")
+
+	ctx, l.cancel = context.WithCancel(ctx)
+	go l.renew()
+	return l, ctx, nil
+}
+
+// tryAcquire tries to acquire the Lease, and returns the current holder.
+func (l *leaseLock) tryAcquire(ctx context.Context) (string, error) {
+	now := metav1.NewMicroTime(time.Now())
+	durationSeconds := int32(l.duration.Seconds())
+
+	var lease *coordinationv1.Lease
+	err := callWithTimeout(ctx, l.timeout, func(ctx context.Context) error {
+		var err error
+		lease, err = l.client.Get(ctx, l.name, metav1.GetOptions{})
+		return err
+	})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: l.name},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.identity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		err = callWithTimeout(ctx, l.timeout, func(ctx context.Context) error {
+			_, err := l.client.Create(ctx, lease, metav1.CreateOptions{})
+			return err
+		})
+		if apierrors.IsAlreadyExists(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("create lease %s failed: %v", l.name, err)
+		}
+		return l.identity, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("get lease %s failed: %v", l.name, err)
+	}
+
+	holder := ""
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+	if holder != "" && holder != l.identity && !leaseExpired(lease) {
+		return holder, nil
+	}
+
+	if holder != l.identity {
+		transitions := int32(0)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions
+		}
+		transitions++
+		lease.Spec.LeaseTransitions = &transitions
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.HolderIdentity = &l.identity
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	lease.Spec.RenewTime = &now
+	err = callWithTimeout(ctx, l.timeout, func(ctx context.Context) error {
+		_, err := l.client.Update(ctx, lease, metav1.UpdateOptions{})
+		return err
+	})
+	if apierrors.IsConflict(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("update lease %s failed: %v", l.name, err)
+	}
+	return l.identity, nil
+}
+
+func leaseExpired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expiredAt := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return time.Now().After(expiredAt)
+}
+
+// renew renews the Lease periodically, the lock is lost when the Lease is taken by another holder,
+// or it is not renewed within the lease duration.
+func (l *leaseLock) renew() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.duration / 3)
+	defer ticker.Stop()
+	renewedAt := time.Now()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.renewTimeout())
+		holder, err := l.tryAcquire(ctx)
+		cancel()
+		if err == nil && holder == l.identity {
+			renewedAt = time.Now()
+			continue
+		}
+		if err == nil && holder != "" {
+			l.lose(fmt.Errorf("lock %s is taken by %s", l.name, holder))
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("the lease is modified concurrently")
+		}
+		if time.Since(renewedAt) > l.duration {
+			l.lose(fmt.Errorf("lock %s is lost, not renewed in %s: %v", l.name, l.duration, err))
+			return
+		}
+		logrus.WithField("name", l.name).Warnf("Renew lock failed: %v", err)
+	}
+}
+
+// renewTimeout bounds renewing or releasing the Lease, it is shorter than the renew interval,
+// so that a hung API server does not block renewing from losing the lock in time.
+func (l *leaseLock) renewTimeout() time.Duration {
+	return l.duration / 4
+}
+
+// lose records the error and cancels the run.
+func (l *leaseLock) lose(err error) {
+	logrus.WithField("name", l.name).Error(err)
+	l.mu.Lock()
+	l.err = err
+	l.mu.Unlock()
+	l.cancel()
+}
+
+// Err returns the error if the lock is lost.
+func (l *leaseLock) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Release stops renewing and deletes the Lease if it is still held.
+func (l *leaseLock) Release() {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+	})
+	<-l.done
+	l.cancel()
+	if l.Err() != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.renewTimeout())
+	defer cancel()
+	var lease *coordinationv1.Lease
+	err := callWithTimeout(ctx, l.timeout, func(ctx context.Context) error {
+		var err error
+		lease, err = l.client.Get(ctx, l.name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		logrus.WithField("name", l.name).Warnf("Release lock failed: %v", err)
+		return
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.identity {
+		return
+	}
+	err = callWithTimeout(ctx, l.timeout, func(ctx context.Context) error {
+		return l.client.Delete(ctx, l.name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+		})
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logrus.WithField("name", l.name).Warnf("Release lock failed: %v", err)
+		return
+	}
+	logrus.WithField("name", l.name).Info("Lock released")
+}
+
+// lockError returns the error of the lost lock in addition to err,
+// the run is not safe even if it succeeded after the lock is lost.
+func lockError(lock *leaseLock, err error) error {
+	lockErr := lock.Err()
+	switch {
+	case lockErr == nil:
+		return err
+	case err == nil:
+		return lockErr
+	}
+	return fmt.Errorf("%v: %v", lockErr, err)
+}
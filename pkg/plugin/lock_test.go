@@ -0,0 +1,166 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	coordinationclientv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+func TestLeaseLock_Lost(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	lock := &Lock{Key: "app", Namespace: "default", Timeout: time.Second, LeaseDuration: 3 * time.Second}
+
+	l, ctx, err := acquireLock(context.Background(), kubeClient, lock, "build#1", time.Second)
+	if err != nil {
+		t.Fatalf("acquireLock() error = %v", err)
+	}
+	defer l.Release()
+
+	if _, _, err := acquireLock(context.Background(), kubeClient, lock, "build#2", time.Second); err == nil {
+		t.Fatal("acquireLock() of another holder error = nil, want error")
+	}
+
+	// another holder takes over the lease
+	leases := kubeClient.CoordinationV1().Leases("default")
+	lease, err := leases.Get(context.Background(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder := "build#2"
+	lease.Spec.HolderIdentity = &holder
+	if _, err := leases.Update(context.Background(), lease, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the context is not canceled after the lock is lost")
+	}
+	if l.Err() == nil {
+		t.Error("Err() = nil, want error")
+	}
+	if err := lockError(l, nil); err == nil {
+		t.Error("lockError() = nil, want error")
+	}
+	if err := lockError(l, errors.New("apply failed")); err == nil || err.Error() == "apply failed" {
+		t.Errorf("lockError() = %v, want the lock error in addition", err)
+	}
+}
+
+func TestLeaseLock_Release(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	lock := &Lock{Key: "app", Namespace: "default", Timeout: time.Second, LeaseDuration: 3 * time.Second}
+
+	l, ctx, err := acquireLock(context.Background(), kubeClient, lock, "build#1", time.Second)
+	if err != nil {
+		t.Fatalf("acquireLock() error = %v", err)
+	}
+	l.Release()
+	if ctx.Err() == nil {
+		t.Error("the context is not canceled after release")
+	}
+	if l.Err() != nil {
+		t.Errorf("Err() = %v, want nil", l.Err())
+	}
+	if _, err := kubeClient.CoordinationV1().Leases("default").Get(context.Background(), "app", metav1.GetOptions{}); err == nil {
+		t.Error("the lease is not deleted after release")
+	}
+}
+
+// hungClientset blocks getting the Leases until the context is done when hung is set.
+type hungClientset struct {
+	*fake.Clientset
+	hung *atomic.Bool
+}
+
+func (c *hungClientset) CoordinationV1() coordinationclientv1.CoordinationV1Interface {
+	return &hungCoordination{CoordinationV1Interface: c.Clientset.CoordinationV1(), hung: c.hung}
+}
+
+type hungCoordination struct {
+	coordinationclientv1.CoordinationV1Interface
+	hung *atomic.Bool
+}
+
+func (c *hungCoordination) Leases(namespace string) coordinationclientv1.LeaseInterface {
+	return &hungLeases{LeaseInterface: c.CoordinationV1Interface.Leases(namespace), hung: c.hung}
+}
+
+type hungLeases struct {
+	coordinationclientv1.LeaseInterface
+	hung *atomic.Bool
+}
+
+func (l *hungLeases) Get(ctx context.Context, name string, opts metav1.GetOptions) (*coordinationv1.Lease, error) {
+	if l.hung.Load() {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return l.LeaseInterface.Get(ctx, name, opts)
+}
+
+func TestLeaseLock_HungServer(t *testing.T) {
+	lock := &Lock{Key: "app", Namespace: "default", Timeout: time.Second, LeaseDuration: 600 * time.Millisecond}
+
+	t.Run("lost", func(t *testing.T) {
+		kubeClient := &hungClientset{Clientset: fake.NewSimpleClientset(), hung: new(atomic.Bool)}
+		// the requests are not bounded by the request timeout
+		l, ctx, err := acquireLock(context.Background(), kubeClient, lock, "build#1", 0)
+		if err != nil {
+			t.Fatalf("acquireLock() error = %v", err)
+		}
+		kubeClient.hung.Store(true)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("the context is not canceled while the API server hangs")
+		}
+		if l.Err() == nil {
+			t.Error("Err() = nil, want error")
+		}
+		l.Release()
+	})
+
+	t.Run("release", func(t *testing.T) {
+		kubeClient := &hungClientset{Clientset: fake.NewSimpleClientset(), hung: new(atomic.Bool)}
+		l, _, err := acquireLock(context.Background(), kubeClient, lock, "build#1", 0)
+		if err != nil {
+			t.Fatalf("acquireLock() error = %v", err)
+		}
+		kubeClient.hung.Store(true)
+
+		done := make(chan struct{})
+		go func() {
+			l.Release()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Release() blocks while the API server hangs")
+		}
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/99nil/gopkg/sets"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+var envNameExp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseJSONPath parses the relaxed JSONPath expression like kubectl,
+// `.spec.clusterIP` is the same as `{.spec.clusterIP}`.
+func parseJSONPath(name, expr string) (*jsonpath.JSONPath, error) {
+	expr = strings.TrimSpace(expr)
+	if !strings.HasPrefix(expr, "{") {
+		if !strings.HasPrefix(expr, ".") {
+			expr = "." + expr
+		}
+		expr = "{" + expr + "}"
+	}
+
+	jp := jsonpath.New(name)
+	if err := jp.Parse(expr); err != nil {
+		return nil, fmt.Errorf("parse JSONPath expression (%s) failed: %v", expr, err)
+	}
+	return jp, nil
+}
+
+// writeOutputs writes the built-in and configured outputs as `KEY=value` lines to the file path.
+func writeOutputs(
+	ctx context.Context,
+	filePath string,
+	cfg *Config,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+) error {
+	cmSet := sets.New[string]()
+	cmNames := make([]string, 0, len(cfg.GetConfigFiles()))
+	for _, v := range cfg.GetConfigFiles() {
+		name := fmt.Sprintf("%s/%s", v.Namespace, v.Name)
+		if cmSet.Has(name) {
+			continue
+		}
+		cmSet.Add(name)
+		cmNames = append(cmNames, name)
+	}
+
+	lines := []string{
+		"K8S_NAMESPACE=" + cfg.Namespace,
+		"K8S_CONFIG_MAPS=" + strings.Join(cmNames, ","),
+	}
+	for _, v := range cfg.Outputs {
+		value, err := evaluateOutput(ctx, dynamicClient, mapping, v, cfg.Namespace, cfg.RequestTimeout)
+		if err != nil {
+			return fmt.Errorf("evaluate output %s failed: %v", v.Key, err)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("evaluate output %s failed: multi-line value is not supported", v.Key)
+		}
+		logrus.WithField("key", v.Key).Debugf("Output: %s", value)
+		lines = append(lines, v.Key+"="+value)
+	}
+
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	return err
+}
+
+func evaluateOutput(
+	ctx context.Context,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	output Output,
+	defNamespace string,
+	requestTimeout time.Duration,
+) (string, error) {
+	gv, err := schema.ParseGroupVersion(output.APIVersion)
+	if err != nil {
+		return "", err
+	}
+	namespace := output.Namespace
+	if namespace == "" {
+		namespace = defNamespace
+	}
+	resourceInter, _, err := newResourceInterface(dynamicClient, mapping, gv.WithKind(output.Kind), namespace)
+	if err != nil {
+		return "", err
+	}
+	obj, err := getWithTimeout(ctx, resourceInter, output.Name, requestTimeout)
+	if err != nil {
+		return "", err
+	}
+
+	jp, err := parseJSONPath(output.Key, output.Path)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := jp.Execute(&buf, obj.Object); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,64 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	obj := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"clusterIP": "10.0.0.1",
+			"ports": []interface{}{
+				map[string]interface{}{"name": "http", "nodePort": int64(30080)},
+				map[string]interface{}{"name": "https", "nodePort": int64(30443)},
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		expr    string
+		want    string
+		wantErr bool
+	}{
+		{name: "braced", expr: "{.spec.clusterIP}", want: "10.0.0.1"},
+		{name: "relaxed", expr: ".spec.clusterIP", want: "10.0.0.1"},
+		{name: "without leading dot", expr: " spec.clusterIP ", want: "10.0.0.1"},
+		{name: "index", expr: ".spec.ports[1].nodePort", want: "30443"},
+		{name: "filter", expr: `{.spec.ports[?(@.name=="http")].nodePort}`, want: "30080"},
+		{name: "invalid", expr: ".spec.ports[", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jp, err := parseJSONPath("test", tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseJSONPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var buf bytes.Buffer
+			if err := jp.Execute(&buf, obj); err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("Execute() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
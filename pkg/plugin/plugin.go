@@ -15,19 +15,24 @@
 package plugin
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	"github.com/99nil/gopkg/sets"
 
 	"github.com/bmatcuk/doublestar/v4"
 
-	pkgruntime "k8s.io/apimachinery/pkg/runtime"
-
 	v1 "k8s.io/api/core/v1"
 
 	"github.com/sirupsen/logrus"
@@ -36,53 +41,208 @@ import (
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/discovery/cached/memory"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/restmapper"
 
 	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+	"github.com/zc2638/drone-k8s-plugin/pkg/redact"
 	"github.com/zc2638/drone-k8s-plugin/pkg/tpl"
 )
 
+const (
+	defaultMaxConcurrency = 10
+	defaultRequestTimeout = time.Minute
+)
+
 var pluginExp = regexp.MustCompile(`^PLUGIN_(.*)=(.*)`)
 
 func run(
+	ctx context.Context,
 	cfg *Config,
 	kubeClient kubernetes.Interface,
 	dynamicClient dynamic.Interface,
 	envMap map[string]string,
-) error {
-	initObjSet, err := parseObjectSet(cfg.InitTemplates, envMap)
+) (err error) {
+	var initObjSet, objSet [][]unstructured.Unstructured
+
+	report := NewReport(cfg.redactor)
+	defer func() {
+		report.Finish(err)
+		if cfg.LogFormat == "json" {
+			report.LogSummary()
+		} else if summaryErr := report.WriteSummary(os.Stdout); summaryErr != nil {
+			logrus.Warnf("write summary failed: %v", summaryErr)
+		}
+
+		if cfg.ReportPath != "" {
+			if writeErr := report.WriteFile(cfg.ReportPath); writeErr != nil {
+				writeErr = fmt.Errorf("write report to %s failed: %v", cfg.ReportPath, writeErr)
+				if err == nil {
+					err = writeErr
+				} else {
+					logrus.Error(writeErr)
+				}
+			}
+		}
+		if cardPath := envMap["DRONE_CARD_PATH"]; cardPath != "" {
+			if writeErr := writeCard(cardPath, cfg, report, initObjSet, objSet); writeErr != nil {
+				logrus.Warnf("write card to %s failed: %v", cardPath, writeErr)
+			}
+		}
+	}()
+
+	initObjSet, err = parseObjectSet(cfg.InitTemplates, envMap, cfg.redactor)
 	if err != nil {
 		return fmt.Errorf("parse init_templates failed: %v", err)
 	}
-	objSet, err := parseObjectSet(cfg.Templates, envMap)
+	objSet, err = parseObjectSet(cfg.Templates, envMap, cfg.redactor)
 	if err != nil {
 		return fmt.Errorf("parse templates failed: %v", err)
 	}
+	kustomizeObjSet, err := buildKustomizations(cfg.KustomizeDirs, cfg.KustomizeTemplate, envMap, cfg.redactor)
+	if err != nil {
+		return err
+	}
+	objSet = append(objSet, kustomizeObjSet...)
+	mapping := newRESTMapper(kubeClient)
+	chartObjSet, err := renderCharts(cfg.Charts, cfg.Namespace, kubeClient, mapping)
+	if err != nil {
+		return err
+	}
+	for _, objs := range chartObjSet {
+		redactSecrets(cfg.redactor, objs)
+	}
+	objSet = append(objSet, chartObjSet...)
 
-	gr, err := restmapper.GetAPIGroupResources(kubeClient.Discovery())
+	hooks, err := extractHooks(&initObjSet, &objSet)
 	if err != nil {
-		return fmt.Errorf("get Kubernetes API group resources failed: %v", err)
+		return err
+	}
+	if cfg.StampMetadata {
+		for _, current := range [][][]unstructured.Unstructured{initObjSet, objSet} {
+			for _, objs := range current {
+				stampObjects(cfg, envMap, objs)
+			}
+		}
+		for _, objs := range hooks {
+			stampObjects(cfg, envMap, objs)
+		}
 	}
-	mapping := restmapper.NewDiscoveryRESTMapper(gr)
 
-	logrus.Debug("Start to apply resources from init templates")
-	if err := applyResources(dynamicClient, mapping, initObjSet, cfg.Namespace); err != nil {
+	hookObjs := make([][]unstructured.Unstructured, 0, len(hooks))
+	for _, objs := range hooks {
+		hookObjs = append(hookObjs, objs)
+	}
+	report.Images, err = overrideImages(cfg.imageOverrides, initObjSet, objSet, hookObjs)
+	if err != nil {
 		return err
 	}
+
+	if cfg.Lock.Key != "" {
+		logrus.Debug("Start to acquire lock")
+		lock, lockCtx, err := acquireLock(ctx, kubeClient, &cfg.Lock, lockIdentity(envMap), cfg.RequestTimeout)
+		if err != nil {
+			return err
+		}
+		ctx = lockCtx
+		defer func() {
+			lock.Release()
+			err = lockError(lock, err)
+		}()
+	}
+
+	defer func() {
+		if err == nil || len(hooks[HookOnFailure]) == 0 {
+			return
+		}
+		logrus.Debug("Start to run on-failure hooks")
+		// the hooks still run when the run is canceled or timed out, they are bounded by wait_timeout.
+		if hookErr := runHooks(context.Background(), kubeClient, dynamicClient, mapping, hooks, HookOnFailure, cfg, report); hookErr != nil {
+			logrus.Error(hookErr)
+		}
+	}()
+
+	// applyErrs are the failures collected when continue_on_error is enabled.
+	var applyErrs []error
+	logrus.Debug("Start to apply resources from init templates")
+	if err := applyResources(ctx, dynamicClient, mapping, initObjSet, cfg, cfg.Namespace, report); err != nil {
+		if !cfg.ContinueOnError {
+			return err
+		}
+		applyErrs = append(applyErrs, err)
+	}
 	logrus.Debug("Start to apply configmaps from config files")
-	if err := applyForConfig(kubeClient, cfg.GetConfigFiles()); err != nil {
+	cms, err := applyForConfig(ctx, kubeClient, cfg.GetConfigFiles(), envMap, cfg, report)
+	if err != nil {
+		if !cfg.ContinueOnError {
+			return err
+		}
+		applyErrs = append(applyErrs, err)
+	}
+	if len(applyErrs) > 0 && len(hooks[HookPreApply]) > 0 {
+		// the pre-apply hooks and the templates depending on them are skipped after failures.
+		logrus.Warn("Skip pre-apply hooks and templates for the previous failures")
+		return utilerrors.Flatten(utilerrors.NewAggregate(applyErrs))
+	}
+	logrus.Debug("Start to run pre-apply hooks")
+	if err := runHooks(ctx, kubeClient, dynamicClient, mapping, hooks, HookPreApply, cfg, report); err != nil {
 		return err
 	}
 	logrus.Debug("Start to apply resources from templates")
-	if err := applyResources(dynamicClient, mapping, objSet, cfg.Namespace); err != nil {
+	if err := applyResources(ctx, dynamicClient, mapping, objSet, cfg, cfg.Namespace, report); err != nil {
+		if !cfg.ContinueOnError {
+			return err
+		}
+		applyErrs = append(applyErrs, err)
+	}
+	if len(applyErrs) > 0 {
+		// the post-apply hooks are skipped after failures, the on-failure hooks run instead.
+		return utilerrors.Flatten(utilerrors.NewAggregate(applyErrs))
+	}
+
+	if cfg.WaitLoadBalancer {
+		logrus.Debug("Start to wait for LoadBalancer addresses")
+		if err := waitLoadBalancers(ctx, dynamicClient, mapping, report, cfg.WaitTimeout, cfg.RequestTimeout); err != nil {
+			return err
+		}
+	}
+
+	logrus.Debug("Start to wait for readiness")
+	if err := waitReadiness(ctx, kubeClient, dynamicClient, mapping, report, cfg); err != nil {
+		return err
+	}
+	logrus.Debug("Start to run post-apply hooks")
+	if err := runHooks(ctx, kubeClient, dynamicClient, mapping, hooks, HookPostApply, cfg, report); err != nil {
 		return err
 	}
+
+	if cfg.History.Name != "" {
+		logrus.Debug("Start to record release")
+		cmObjSet, err := configMapsToObjectSet(cms)
+		if err != nil {
+			return err
+		}
+		manifests := newManifests(initObjSet, cmObjSet, objSet)
+		if err := recordRelease(ctx, kubeClient, cfg, envMap, "", manifests); err != nil {
+			return err
+		}
+	}
+
+	if outputPath := envMap["DRONE_OUTPUT"]; outputPath != "" {
+		logrus.Debug("Start to write outputs")
+		if err := writeOutputs(ctx, outputPath, cfg, dynamicClient, mapping); err != nil {
+			return fmt.Errorf("write outputs to %s failed: %v", outputPath, err)
+		}
+	}
 	return nil
 }
 
-func parseObjectSet(templates []string, envMap map[string]string) ([][]unstructured.Unstructured, error) {
+func parseObjectSet(templates []string, envMap map[string]string, redactor *redact.Redactor) ([][]unstructured.Unstructured, error) {
 	fileSet := sets.New[string]()
 	for _, v := range templates {
 		matches, err := doublestar.FilepathGlob(v)
@@ -114,87 +274,80 @@ func parseObjectSet(templates []string, envMap map[string]string) ([][]unstructu
 		if err != nil {
 			return nil, fmt.Errorf("render template file(%s) failed: %v", v, err)
 		}
-
 		result, err := kube.ParseObject(current)
 		if err != nil {
 			return nil, fmt.Errorf("parse template file(%s) failed: %v", v, err)
 		}
+		redactSecrets(redactor, result)
+		logrus.Debugf("Rendered template file(%s):\n%s", v, current)
 		objSet = append(objSet, result)
 	}
 	return objSet, nil
 }
 
+// redactSecrets registers the values in `data` and `stringData` of the Secrets to the redactor,
+// so that they are masked when the rendered templates are printed.
+func redactSecrets(redactor *redact.Redactor, objs []unstructured.Unstructured) {
+	if redactor == nil {
+		return
+	}
+	for _, obj := range objs {
+		if obj.GetAPIVersion() != "v1" || obj.GetKind() != "Secret" {
+			continue
+		}
+		data, _, _ := unstructured.NestedStringMap(obj.Object, "data")
+		for _, v := range data {
+			redactor.AddValues(v)
+			if decoded, err := base64.StdEncoding.DecodeString(v); err == nil {
+				redactor.AddValues(string(decoded))
+			}
+		}
+		stringData, _, _ := unstructured.NestedStringMap(obj.Object, "stringData")
+		for _, v := range stringData {
+			redactor.AddValues(v)
+		}
+	}
+}
+
 func applyResources(
+	ctx context.Context,
 	dynamicClient dynamic.Interface,
 	mapping meta.RESTMapper,
 	objSet [][]unstructured.Unstructured,
+	cfg *Config,
 	defNamespace string,
+	report *Report,
 ) error {
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
 	for _, objs := range objSet {
-		eg, ctx := errgroup.WithContext(context.Background())
+		eg, egCtx := errgroup.WithContext(ctx)
+		if cfg.ContinueOnError {
+			// the failure of an object does not cancel the others
+			eg, egCtx = new(errgroup.Group), ctx
+		}
+		eg.SetLimit(cfg.MaxConcurrency)
 
+		var crds []*unstructured.Unstructured
 		for _, obj := range objs {
 			objCopy := obj.DeepCopy()
 
 			eg.Go(func() error {
-				gvk := objCopy.GroupVersionKind()
-				logrus.WithField("apiVersion", gvk.GroupVersion().String()).
-					WithField("kind", gvk.Kind).
-					WithField("namespace", objCopy.GetNamespace()).
-					WithField("name", objCopy.GetName()).
-					Info("Apply Resource")
-
-				restMapping, err := mapping.RESTMapping(gvk.GroupKind(), gvk.Version)
-				if err != nil {
-					return err
-				}
-
-				var resourceInter dynamic.ResourceInterface
-				if restMapping.Scope.Name() == meta.RESTScopeNameNamespace {
-					if objCopy.GetNamespace() == "" {
-						if defNamespace == "" {
-							return fmt.Errorf(
-								"apply resource failed: namespace must be defined, apiVersion=%s, kind=%s, name=%s",
-								gvk.GroupVersion().String(), gvk.Kind, objCopy.GetName(),
-							)
-						}
-						// set default namespace
-						objCopy.SetNamespace(defNamespace)
-					}
-					resourceInter = dynamicClient.Resource(restMapping.Resource).Namespace(objCopy.GetNamespace())
-				} else {
-					resourceInter = dynamicClient.Resource(restMapping.Resource)
+				start := time.Now()
+				action, err := applyResource(egCtx, dynamicClient, mapping, objCopy, cfg, defNamespace)
+				report.Add(objCopy, action, start, err)
+				if err == nil && isCustomResourceDefinition(objCopy) {
+					mu.Lock()
+					crds = append(crds, objCopy)
+					mu.Unlock()
 				}
-
-				// apply
-				origin, err := resourceInter.Get(ctx, objCopy.GetName(), metav1.GetOptions{
-					TypeMeta: metav1.TypeMeta{
-						Kind:       objCopy.GetKind(),
-						APIVersion: objCopy.GetAPIVersion(),
-					},
-				})
-				if err == nil {
-					switch objCopy.GetKind() {
-					case "Service":
-						objCopy, err = completeService(origin, objCopy)
-						if err != nil {
-							return err
-						}
-					default:
-					}
-
-					rv, _ := strconv.ParseInt(origin.GetResourceVersion(), 10, 64)
-					objCopy.SetResourceVersion(strconv.FormatInt(rv, 10))
-					if _, err = resourceInter.Update(ctx, objCopy, metav1.UpdateOptions{}); err != nil {
-						err = fmt.Errorf("update %s %s failed: %v", objCopy.GetKind(), objCopy.GetName(), err)
-					}
-					return err
-				}
-				if !apierrors.IsNotFound(err) {
-					return err
-				}
-				if _, err = resourceInter.Create(ctx, objCopy, metav1.CreateOptions{}); err != nil {
-					err = fmt.Errorf("create %s %s failed: %v", objCopy.GetKind(), objCopy.GetName(), err)
+				if err != nil && cfg.ContinueOnError {
+					mu.Lock()
+					errs = append(errs, objectError(objCopy, err))
+					mu.Unlock()
+					return nil
 				}
 				return err
 			})
@@ -202,46 +355,238 @@ func applyResources(
 		if err := eg.Wait(); err != nil {
 			return err
 		}
+		if len(crds) == 0 {
+			continue
+		}
+		// the new kinds are discovered for the next sets once the CRDs are established
+		err := waitEstablished(ctx, dynamicClient, mapping, crds, cfg.WaitTimeout, cfg.RequestTimeout)
+		meta.MaybeResetRESTMapper(mapping)
+		if err != nil && !cfg.ContinueOnError {
+			return err
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
 	}
-	return nil
+	return utilerrors.NewAggregate(errs)
 }
 
-func completeService(origin, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
-	var (
-		originSvc v1.Service
-		objSvc    v1.Service
-	)
-	if err := pkgruntime.DefaultUnstructuredConverter.FromUnstructured(origin.UnstructuredContent(), &originSvc); err != nil {
-		return nil, fmt.Errorf("convert origin unstructured object %s to Service failed: %v", obj.GetName(), err)
+// isCustomResourceDefinition reports whether obj is a CustomResourceDefinition.
+func isCustomResourceDefinition(obj *unstructured.Unstructured) bool {
+	gvk := obj.GroupVersionKind()
+	return gvk.Group == "apiextensions.k8s.io" && gvk.Kind == "CustomResourceDefinition"
+}
+
+// objectError adds the kind, namespace and name of obj to err.
+func objectError(obj *unstructured.Unstructured, err error) error {
+	name := obj.GetName()
+	if obj.GetNamespace() != "" {
+		name = obj.GetNamespace() + "/" + name
+	}
+	return fmt.Errorf("%s %s: %v", obj.GetKind(), name, err)
+}
+
+func applyResource(
+	ctx context.Context,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	obj *unstructured.Unstructured,
+	cfg *Config,
+	defNamespace string,
+) (Action, error) {
+	gvk := obj.GroupVersionKind()
+	logrus.WithField("apiVersion", gvk.GroupVersion().String()).
+		WithField("kind", gvk.Kind).
+		WithField("namespace", obj.GetNamespace()).
+		WithField("name", obj.GetName()).
+		Info("Apply Resource")
+
+	namespace := obj.GetNamespace()
+	if namespace == "" {
+		namespace = defNamespace
+	}
+	resourceInter, namespaced, err := newResourceInterface(dynamicClient, mapping, gvk, namespace)
+	if err != nil {
+		return ActionFailed, err
+	}
+	if namespaced {
+		if namespace == "" {
+			return ActionFailed, fmt.Errorf(
+				"apply resource failed: namespace must be defined, apiVersion=%s, kind=%s, name=%s",
+				gvk.GroupVersion().String(), gvk.Kind, obj.GetName(),
+			)
+		}
+		// set default namespace
+		obj.SetNamespace(namespace)
+	}
+
+	var action Action
+	logger := logrus.WithField("kind", gvk.Kind).
+		WithField("namespace", obj.GetNamespace()).
+		WithField("name", obj.GetName())
+	retryable := isRetryableError
+	if obj.GetName() == "" && obj.GetGenerateName() != "" {
+		retryable = isRetryableCreateError
+	}
+	runCtx := ctx
+	err = withRetry(ctx, &cfg.Retry, cfg.RequestTimeout, logger, retryable, func(ctx context.Context) error {
+		var err error
+		action, err = applyObject(ctx, runCtx, dynamicClient, mapping, resourceInter, obj, cfg)
+		return err
+	})
+	if err != nil {
+		return ActionFailed, err
+	}
+	return action, nil
+}
+
+// applyObject updates the live object, or creates obj if it is not found.
+// ctx is bounded by the request timeout, runCtx is not, it is used to replace the object
+// since waiting for the deletion is bounded by the wait timeout instead.
+func applyObject(
+	ctx context.Context,
+	runCtx context.Context,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	resourceInter dynamic.ResourceInterface,
+	obj *unstructured.Unstructured,
+	cfg *Config,
+) (Action, error) {
+	policy, err := applyPolicy(obj)
+	if err != nil {
+		return ActionFailed, err
 	}
-	if err := pkgruntime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), &objSvc); err != nil {
-		return nil, fmt.Errorf("convert unstructured object %s to Service failed: %v", obj.GetName(), err)
+	if obj.GetName() == "" && obj.GetGenerateName() != "" {
+		return createObject(ctx, resourceInter, obj)
 	}
 
-	objSvc.Spec.ClusterIP = originSvc.Spec.ClusterIP
-	objSvc.Spec.ClusterIPs = originSvc.Spec.ClusterIPs
+	origin, err := resourceInter.Get(ctx, obj.GetName(), metav1.GetOptions{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       obj.GetKind(),
+			APIVersion: obj.GetAPIVersion(),
+		},
+	})
+	if err == nil {
+		switch policy {
+		case ApplyPolicyCreateOnly:
+			logrus.WithField("kind", obj.GetKind()).
+				WithField("namespace", obj.GetNamespace()).
+				WithField("name", obj.GetName()).
+				Info("Resource exists, skip updating the create-only resource")
+			return ActionUnchanged, nil
+		case ApplyPolicyReplace:
+			if err := replaceResource(runCtx, resourceInter, obj, cfg.WaitTimeout, cfg.RequestTimeout, "by the apply policy"); err != nil {
+				return ActionFailed, fmt.Errorf("replace %s %s failed: %w", obj.GetKind(), obj.GetName(), err)
+			}
+			return ActionReplaced, nil
+		}
+
+		current := obj.DeepCopy()
+		if err := preserveFields(ctx, dynamicClient, mapping, cfg.PreserveFields, origin, current); err != nil {
+			return ActionFailed, err
+		}
+
+		rv, _ := strconv.ParseInt(origin.GetResourceVersion(), 10, 64)
+		current.SetResourceVersion(strconv.FormatInt(rv, 10))
+		if isUnchanged(ctx, resourceInter, origin, current) {
+			logrus.WithField("kind", obj.GetKind()).
+				WithField("namespace", obj.GetNamespace()).
+				WithField("name", obj.GetName()).
+				Info("Resource unchanged, skip updating")
+			return ActionUnchanged, nil
+		}
+		_, err = resourceInter.Update(ctx, current, metav1.UpdateOptions{})
+		if err != nil && isImmutableFieldError(err) {
+			force, forceErr := shouldForceReplace(cfg, obj)
+			if forceErr != nil {
+				return ActionFailed, forceErr
+			}
+			if force {
+				if err := replaceResource(runCtx, resourceInter, obj, cfg.WaitTimeout, cfg.RequestTimeout, "for the immutable fields changed"); err != nil {
+					return ActionFailed, fmt.Errorf("replace %s %s failed: %w", obj.GetKind(), obj.GetName(), err)
+				}
+				return ActionReplaced, nil
+			}
+		}
+		if err != nil {
+			return ActionFailed, fmt.Errorf("update %s %s failed: %w", obj.GetKind(), obj.GetName(), err)
+		}
+		return ActionUpdated, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return ActionFailed, err
+	}
+	return createObject(ctx, resourceInter, obj)
+}
 
-	unstructuredContent, err := pkgruntime.DefaultUnstructuredConverter.ToUnstructured(&objSvc)
+// createObject creates obj, the name generated from generateName is set back to obj.
+func createObject(ctx context.Context, resourceInter dynamic.ResourceInterface, obj *unstructured.Unstructured) (Action, error) {
+	created, err := resourceInter.Create(ctx, obj, metav1.CreateOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("convert Service %s to unstructured object failed: %v", objSvc.GetName(), err)
+		name := obj.GetName()
+		if name == "" {
+			name = obj.GetGenerateName()
+		}
+		return ActionFailed, fmt.Errorf("create %s %s failed: %w", obj.GetKind(), name, err)
 	}
+	if obj.GetName() == "" {
+		obj.SetName(created.GetName())
+		logrus.WithField("kind", obj.GetKind()).
+			WithField("namespace", obj.GetNamespace()).
+			WithField("name", obj.GetName()).
+			Info("Create Resource with generated name")
+	}
+	return ActionCreated, nil
+}
+
+// newRESTMapper returns the mapping discovered lazily from the cluster,
+// it is reset after the CRDs are applied, see applyResources.
+func newRESTMapper(kubeClient kubernetes.Interface) meta.ResettableRESTMapper {
+	return restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(kubeClient.Discovery()))
+}
 
-	current := &unstructured.Unstructured{}
-	current.SetUnstructuredContent(unstructuredContent)
-	return current, nil
+// newResourceInterface returns the resource interface of the gvk and whether the resource is namespaced,
+// namespace is ignored if the resource is cluster-scoped.
+func newResourceInterface(
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	gvk schema.GroupVersionKind,
+	namespace string,
+) (dynamic.ResourceInterface, bool, error) {
+	restMapping, err := mapping.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, false, err
+	}
+	if restMapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		return dynamicClient.Resource(restMapping.Resource).Namespace(namespace), true, nil
+	}
+	return dynamicClient.Resource(restMapping.Resource), false, nil
 }
 
-func applyForConfig(kubeClient kubernetes.Interface, cfs []ConfigFile) error {
+// applyForConfig creates or updates the ConfigMaps from config files, and returns the applied ConfigMaps.
+func applyForConfig(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	cfs []ConfigFile,
+	envMap map[string]string,
+	cfg *Config,
+	report *Report,
+) ([]*v1.ConfigMap, error) {
 	if len(cfs) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	cmSet := make(map[string]*v1.ConfigMap)
+	cms := make([]*v1.ConfigMap, 0, len(cfs))
 	for _, v := range cfs {
 		key := fmt.Sprintf("%s/%s", v.Namespace, v.Name)
 		cm, ok := cmSet[key]
 		if !ok {
 			cm = &v1.ConfigMap{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: "v1",
+					Kind:       "ConfigMap",
+				},
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      v.Name,
 					Namespace: v.Namespace,
@@ -249,42 +594,149 @@ func applyForConfig(kubeClient kubernetes.Interface, cfs []ConfigFile) error {
 				Data: make(map[string]string),
 			}
 			cmSet[key] = cm
+			cms = append(cms, cm)
 		}
 
-		fileBytes, err := os.ReadFile(v.FilePath)
-		if err != nil {
-			return err
+		for _, item := range v.Files {
+			fileBytes, err := os.ReadFile(item.Path)
+			if err != nil {
+				return nil, err
+			}
+			switch item.Template {
+			case TemplateModeGo:
+				fileBytes, err = tpl.RenderWithValues(fileBytes, envMap, v.Values)
+			case TemplateModeEnvsubst:
+				fileBytes, err = tpl.Envsubst(fileBytes, envMap)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("render config file(%s) failed: %v", item.Path, err)
+			}
+			if item.Template != TemplateModeNone {
+				logrus.Debugf("Rendered config file(%s):\n%s", item.Path, fileBytes)
+			}
+			if err := setConfigMapData(cm, item.Key, string(fileBytes)); err != nil {
+				return nil, err
+			}
+		}
+		for _, envFile := range v.EnvFiles {
+			data, err := readEnvFile(envFile, envMap)
+			if err != nil {
+				return nil, err
+			}
+			for _, kv := range data {
+				if err := setConfigMapData(cm, kv[0], kv[1]); err != nil {
+					return nil, err
+				}
+			}
 		}
-		filename := v.FileName
-		if len(filename) == 0 {
-			_, filename = filepath.Split(v.FilePath)
+		for k, val := range v.Literals {
+			if err := setConfigMapData(cm, k, val); err != nil {
+				return nil, err
+			}
 		}
-		cm.Data[filename] = string(fileBytes)
 	}
 
-	for _, cm := range cmSet {
-		cmInter := kubeClient.CoreV1().ConfigMaps(cm.Namespace)
-		origin, err := cmInter.Get(context.Background(), cm.Name, metav1.GetOptions{})
-		if err == nil {
-			rv, _ := strconv.ParseInt(origin.GetResourceVersion(), 10, 64)
-			cm.SetResourceVersion(strconv.FormatInt(rv, 10))
-			if _, err := cmInter.Update(context.Background(), cm, metav1.UpdateOptions{}); err != nil {
-				return fmt.Errorf("update ConfigMap %s failed: %v", cm.Name, err)
+	var errs []error
+	for _, cm := range cms {
+		start := time.Now()
+		var action Action
+		logger := logrus.WithField("kind", "ConfigMap").
+			WithField("namespace", cm.Namespace).
+			WithField("name", cm.Name)
+		err := withRetry(ctx, &cfg.Retry, cfg.RequestTimeout, logger, isRetryableError, func(ctx context.Context) error {
+			var err error
+			action, err = applyConfigMap(ctx, kubeClient, cm)
+			return err
+		})
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion("v1")
+		obj.SetKind("ConfigMap")
+		obj.SetNamespace(cm.Namespace)
+		obj.SetName(cm.Name)
+		report.Add(obj, action, start, err)
+		if err != nil {
+			if !cfg.ContinueOnError {
+				return nil, err
 			}
+			errs = append(errs, objectError(obj, err))
+		}
+	}
+	return cms, utilerrors.NewAggregate(errs)
+}
+
+func applyConfigMap(ctx context.Context, kubeClient kubernetes.Interface, cm *v1.ConfigMap) (Action, error) {
+	cmInter := kubeClient.CoreV1().ConfigMaps(cm.Namespace)
+	origin, err := cmInter.Get(ctx, cm.Name, metav1.GetOptions{})
+	if err == nil {
+		if isConfigMapUnchanged(origin, cm) {
 			logrus.WithField("namespace", cm.Namespace).
 				WithField("name", cm.Name).
-				Infof("Update ConfigMap")
-			continue
+				Infof("ConfigMap unchanged, skip updating")
+			return ActionUnchanged, nil
 		}
-		if !apierrors.IsNotFound(err) {
-			return err
-		}
-		if _, err := cmInter.Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
-			return fmt.Errorf("create ConfigMap %s failed: %v", cm.Name, err)
+		rv, _ := strconv.ParseInt(origin.GetResourceVersion(), 10, 64)
+		cm.SetResourceVersion(strconv.FormatInt(rv, 10))
+		if _, err := cmInter.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			return ActionFailed, fmt.Errorf("update ConfigMap %s failed: %w", cm.Name, err)
 		}
 		logrus.WithField("namespace", cm.Namespace).
 			WithField("name", cm.Name).
-			Infof("Create ConfigMap")
+			Infof("Update ConfigMap")
+		return ActionUpdated, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return ActionFailed, err
 	}
+	if _, err := cmInter.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		return ActionFailed, fmt.Errorf("create ConfigMap %s failed: %w", cm.Name, err)
+	}
+	logrus.WithField("namespace", cm.Namespace).
+		WithField("name", cm.Name).
+		Infof("Create ConfigMap")
+	return ActionCreated, nil
+}
+
+func setConfigMapData(cm *v1.ConfigMap, key, value string) error {
+	if _, ok := cm.Data[key]; ok {
+		return fmt.Errorf("cannot add key %s to ConfigMap %s/%s, another key by that name already exists", key, cm.Namespace, cm.Name)
+	}
+	cm.Data[key] = value
 	return nil
 }
+
+// readEnvFile reads the `.env` style file and returns the key/value pairs in order.
+// Empty lines and lines beginning with `#` are ignored,
+// a line without `=` takes its value from the environment variables.
+func readEnvFile(filePath string, envMap map[string]string) ([][2]string, error) {
+	fileBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("read env file(%s) failed: %v", filePath, err)
+	}
+	fileBytes = bytes.TrimPrefix(fileBytes, []byte("\xEF\xBB\xBF"))
+
+	var result [][2]string
+	scanner := bufio.NewScanner(bytes.NewReader(fileBytes))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimLeftFunc(scanner.Text(), unicode.IsSpace)
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, "=", 2)
+		key := parts[0]
+		if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+			return nil, fmt.Errorf("env file(%s) line %d: invalid key (%s): %s", filePath, line, key, strings.Join(errs, ";"))
+		}
+		if len(parts) == 2 {
+			result = append(result, [2]string{key, parts[1]})
+			continue
+		}
+		if val, ok := envMap[key]; ok {
+			result = append(result, [2]string{key, val})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read env file(%s) failed: %v", filePath, err)
+	}
+	return result, nil
+}
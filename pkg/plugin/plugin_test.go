@@ -0,0 +1,234 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	pkgruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/redact"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	envMap := map[string]string{"FROM_ENV": "env-value"}
+
+	tests := []struct {
+		name    string
+		content string
+		want    [][2]string
+		wantErr bool
+	}{
+		{
+			name:    "key value pairs in order",
+			content: "B=2\nA=1\n",
+			want:    [][2]string{{"B", "2"}, {"A", "1"}},
+		},
+		{
+			name:    "comments, empty lines and BOM",
+			content: "\xEF\xBB\xBF# comment\n\n  A=1\n",
+			want:    [][2]string{{"A", "1"}},
+		},
+		{
+			name:    "value containing equal sign",
+			content: "DSN=user=root;password=x\n",
+			want:    [][2]string{{"DSN", "user=root;password=x"}},
+		},
+		{
+			name:    "empty value",
+			content: "A=\n",
+			want:    [][2]string{{"A", ""}},
+		},
+		{
+			name:    "value from environment",
+			content: "FROM_ENV\nMISSING\n",
+			want:    [][2]string{{"FROM_ENV", "env-value"}},
+		},
+		{
+			name:    "invalid key",
+			content: "A B=1\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "app.env")
+			if err := os.WriteFile(filePath, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readEnvFile(filePath, envMap)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readEnvFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readEnvFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readEnvFile(filepath.Join(t.TempDir(), "missing.env"), envMap); err == nil {
+		t.Error("readEnvFile() of missing file error = nil, want error")
+	}
+}
+
+func TestSetConfigMapData(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		key     string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "new key",
+			data: map[string]string{"a": "1"},
+			key:  "b",
+			want: map[string]string{"a": "1", "b": "value"},
+		},
+		{
+			name:    "duplicate key",
+			data:    map[string]string{"a": "1"},
+			key:     "a",
+			want:    map[string]string{"a": "1"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := &v1.ConfigMap{Data: tt.data}
+			cm.Namespace, cm.Name = "default", "app"
+			err := setConfigMapData(cm, tt.key, "value")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setConfigMapData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(cm.Data, tt.want) {
+				t.Errorf("setConfigMapData() data = %v, want %v", cm.Data, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseObjectSet_RedactSecrets(t *testing.T) {
+	envMap := map[string]string{"DB_USER": "admin-user", "DB_PASS": "p4ssw0rd-value"}
+	redactor := redact.New()
+	redactor.AddEnv(envMap)
+
+	content := `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+data:
+  password: {{ .env.DB_PASS | b64enc }}
+  dsn: {{ printf "%s:%s@db" .env.DB_USER .env.DB_PASS | b64enc }}
+stringData:
+  user: {{ .env.DB_USER }}
+`
+	filePath := filepath.Join(t.TempDir(), "secret.yaml")
+	if err := os.WriteFile(filePath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	logger := logrus.StandardLogger()
+	out, formatter, level := logger.Out, logger.Formatter, logger.Level
+	defer func() {
+		logger.SetOutput(out)
+		logger.SetFormatter(formatter)
+		logger.SetLevel(level)
+	}()
+	logger.SetOutput(&logs)
+	logger.SetFormatter(redactor.Formatter(&logrus.TextFormatter{}))
+	logger.SetLevel(logrus.DebugLevel)
+
+	if _, err := parseObjectSet([]string{filePath}, envMap, redactor); err != nil {
+		t.Fatalf("parseObjectSet() error = %v", err)
+	}
+	dump := logs.String()
+	for _, secret := range []string{"cDRzc3cwcmQtdmFsdWU=", "YWRtaW4tdXNlcjpwNHNzdzByZC12YWx1ZUBkYg==", "admin-user"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("the rendered template contains %s:\n%s", secret, dump)
+		}
+	}
+	if !strings.Contains(dump, redact.Mask) {
+		t.Errorf("the rendered template is not dumped:\n%s", dump)
+	}
+}
+
+type resetRESTMapper struct {
+	*meta.DefaultRESTMapper
+	resets int
+}
+
+func (m *resetRESTMapper) Reset() { m.resets++ }
+
+func TestApplyResources_WaitEstablished(t *testing.T) {
+	crdGVK := schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}
+	crdGVR := schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+	tests := []struct {
+		name        string
+		established bool
+		wantErr     bool
+	}{
+		{name: "established", established: true},
+		{name: "not established", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crd := unstructured.Unstructured{Object: map[string]interface{}{}}
+			crd.SetGroupVersionKind(crdGVK)
+			crd.SetName("crontabs.example.com")
+
+			dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(pkgruntime.NewScheme(),
+				map[schema.GroupVersionResource]string{crdGVR: "CustomResourceDefinitionList"})
+			dynamicClient.PrependReactor("create", "customresourcedefinitions", func(action clienttesting.Action) (bool, pkgruntime.Object, error) {
+				if tt.established {
+					obj := action.(clienttesting.CreateAction).GetObject().(*unstructured.Unstructured)
+					_ = unstructured.SetNestedSlice(obj.Object, []interface{}{
+						map[string]interface{}{"type": "Established", "status": "True"},
+					}, "status", "conditions")
+				}
+				return false, nil, nil
+			})
+
+			mapping := &resetRESTMapper{DefaultRESTMapper: meta.NewDefaultRESTMapper(nil)}
+			mapping.Add(crdGVK, meta.RESTScopeRoot)
+			cfg := &Config{MaxConcurrency: 1, WaitTimeout: 100 * time.Millisecond, RequestTimeout: time.Second}
+
+			err := applyResources(context.Background(), dynamicClient, mapping,
+				[][]unstructured.Unstructured{{crd}}, cfg, "default", NewReport(nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyResources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if mapping.resets != 1 {
+				t.Errorf("mapping resets = %d, want 1", mapping.resets)
+			}
+		})
+	}
+}
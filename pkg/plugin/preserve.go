@@ -0,0 +1,335 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// PreserveRule preserves the fields of the live object when updating the objects of the kind.
+type PreserveRule struct {
+	// APIVersion is optional, all versions of the kind are matched if it is empty.
+	APIVersion string `json:"api_version"`
+	Kind       string `json:"kind"`
+	// Paths are the dot-separated field paths, e.g. `.spec.replicas`, see parseFieldPath.
+	Paths []string `json:"paths"`
+}
+
+func (r *PreserveRule) Validate() error {
+	if r.Kind == "" {
+		return errors.New("kind must be defined")
+	}
+	if len(r.Paths) == 0 {
+		return errors.New("paths must be defined")
+	}
+	for _, v := range r.Paths {
+		if _, err := parseFieldPath(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *PreserveRule) Match(apiVersion, kind string) bool {
+	return matchKind(r.APIVersion, r.Kind, apiVersion, kind)
+}
+
+// parseFieldPath parses the dot-separated field path, e.g. `.spec.replicas`.
+// The keys containing dots are quoted in brackets, e.g. `.metadata.annotations['example.com/key']`,
+// or the dots are escaped, e.g. `.metadata.annotations.example\.com/key`.
+func parseFieldPath(path string) ([]string, error) {
+	invalid := func(reason string) error {
+		return fmt.Errorf("invalid field path (%s): %s", path, reason)
+	}
+
+	var (
+		fields  []string
+		current strings.Builder
+		// bracketed means the last field is closed by a bracket
+		bracketed bool
+	)
+	s := strings.TrimPrefix(path, ".")
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			if i+1 == len(s) {
+				return nil, invalid("trailing escape")
+			}
+			i++
+			current.WriteByte(s[i])
+		case '.':
+			if current.Len() == 0 && !bracketed {
+				return nil, invalid("empty field")
+			}
+			if current.Len() > 0 {
+				fields = append(fields, current.String())
+				current.Reset()
+			}
+			bracketed = false
+		case '[':
+			if current.Len() > 0 {
+				fields = append(fields, current.String())
+				current.Reset()
+			}
+			if i+1 == len(s) || (s[i+1] != '\'' && s[i+1] != '"') {
+				return nil, invalid("the key in brackets must be quoted")
+			}
+			start := i + 2
+			end := strings.IndexByte(s[start:], s[i+1])
+			if end < 0 || start+end+1 == len(s) || s[start+end+1] != ']' {
+				return nil, invalid("unterminated brackets")
+			}
+			if end == 0 {
+				return nil, invalid("empty field")
+			}
+			fields = append(fields, s[start:start+end])
+			i = start + end + 1
+			if i+1 < len(s) && s[i+1] != '.' && s[i+1] != '[' {
+				return nil, invalid("unexpected character after brackets")
+			}
+			bracketed = true
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if current.Len() > 0 {
+		fields = append(fields, current.String())
+	} else if !bracketed {
+		return nil, invalid("empty field")
+	}
+	return fields, nil
+}
+
+// fieldPreserver copies the fields which are assigned by the server or managed by others
+// from the live object to the object to update.
+type fieldPreserver func(
+	ctx context.Context,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	live, obj *unstructured.Unstructured,
+) error
+
+// fieldPreservers are the built-in preservers of kinds, add the preservers here to support more kinds.
+var fieldPreservers = map[schema.GroupKind][]fieldPreserver{
+	{Kind: "Service"}:                    {preserveClusterIP, preserveNodePorts},
+	{Kind: "PersistentVolumeClaim"}:      {preserveVolumeName},
+	{Group: "batch", Kind: "Job"}:        {preserveJobSelector},
+	{Group: "apps", Kind: "Deployment"}:  {preserveScaledReplicas},
+	{Group: "apps", Kind: "StatefulSet"}: {preserveScaledReplicas},
+}
+
+// preserveFields applies the built-in preservers and the preserve rules to obj.
+func preserveFields(
+	ctx context.Context,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	rules []PreserveRule,
+	live, obj *unstructured.Unstructured,
+) error {
+	gvk := obj.GroupVersionKind()
+	for _, preserver := range fieldPreservers[gvk.GroupKind()] {
+		if err := preserver(ctx, dynamicClient, mapping, live, obj); err != nil {
+			return fmt.Errorf("preserve fields of %s %s failed: %v", gvk.Kind, obj.GetName(), err)
+		}
+	}
+
+	for _, rule := range rules {
+		if !rule.Match(obj.GetAPIVersion(), obj.GetKind()) {
+			continue
+		}
+		for _, path := range rule.Paths {
+			fields, err := parseFieldPath(path)
+			if err != nil {
+				return err
+			}
+			if err := copyNestedField(live, obj, fields...); err != nil {
+				return fmt.Errorf("preserve field %s of %s %s failed: %v", path, gvk.Kind, obj.GetName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// copyNestedField copies the field from the live object, nothing changes if the live object has no such field.
+func copyNestedField(live, obj *unstructured.Unstructured, fields ...string) error {
+	value, found, err := unstructured.NestedFieldCopy(live.Object, fields...)
+	if err != nil || !found {
+		return err
+	}
+	return unstructured.SetNestedField(obj.Object, value, fields...)
+}
+
+// copyOmittedField copies the field from the live object if obj does not define it.
+func copyOmittedField(live, obj *unstructured.Unstructured, fields ...string) error {
+	if _, found, _ := unstructured.NestedFieldNoCopy(obj.Object, fields...); found {
+		return nil
+	}
+	return copyNestedField(live, obj, fields...)
+}
+
+// preserveClusterIP keeps the allocated cluster IPs, which are immutable.
+func preserveClusterIP(_ context.Context, _ dynamic.Interface, _ meta.RESTMapper, live, obj *unstructured.Unstructured) error {
+	if err := copyNestedField(live, obj, "spec", "clusterIP"); err != nil {
+		return err
+	}
+	return copyNestedField(live, obj, "spec", "clusterIPs")
+}
+
+// preserveNodePorts keeps the allocated node ports of the ports which omit nodePort,
+// and the allocated healthCheckNodePort.
+func preserveNodePorts(_ context.Context, _ dynamic.Interface, _ meta.RESTMapper, live, obj *unstructured.Unstructured) error {
+	serviceType, _, _ := unstructured.NestedString(obj.Object, "spec", "type")
+	if serviceType != "NodePort" && serviceType != "LoadBalancer" {
+		return nil
+	}
+
+	livePorts, _, err := unstructured.NestedSlice(live.Object, "spec", "ports")
+	if err != nil {
+		return err
+	}
+	ports, found, err := unstructured.NestedSlice(obj.Object, "spec", "ports")
+	if err != nil || !found {
+		return err
+	}
+	for _, v := range ports {
+		port, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, ok := port["nodePort"]; ok {
+			continue
+		}
+		for _, lv := range livePorts {
+			livePort, ok := lv.(map[string]interface{})
+			if !ok || !sameServicePort(livePort, port) {
+				continue
+			}
+			if nodePort, ok := livePort["nodePort"]; ok {
+				port["nodePort"] = nodePort
+			}
+			break
+		}
+	}
+	if err := unstructured.SetNestedSlice(obj.Object, ports, "spec", "ports"); err != nil {
+		return err
+	}
+	return copyOmittedField(live, obj, "spec", "healthCheckNodePort")
+}
+
+// sameServicePort reports whether the ports have the same port number and protocol.
+func sameServicePort(a, b map[string]interface{}) bool {
+	protocol := func(m map[string]interface{}) string {
+		if v, _ := m["protocol"].(string); v != "" {
+			return v
+		}
+		return "TCP"
+	}
+	return fmt.Sprint(a["port"]) == fmt.Sprint(b["port"]) && protocol(a) == protocol(b)
+}
+
+// preserveVolumeName keeps the bound volume of PersistentVolumeClaim.
+func preserveVolumeName(_ context.Context, _ dynamic.Interface, _ meta.RESTMapper, live, obj *unstructured.Unstructured) error {
+	return copyOmittedField(live, obj, "spec", "volumeName")
+}
+
+// preserveJobSelector keeps the generated selector of Job and the pod template labels it selects.
+func preserveJobSelector(_ context.Context, _ dynamic.Interface, _ meta.RESTMapper, live, obj *unstructured.Unstructured) error {
+	if err := copyOmittedField(live, obj, "spec", "selector"); err != nil {
+		return err
+	}
+
+	matchLabels, _, err := unstructured.NestedStringMap(obj.Object, "spec", "selector", "matchLabels")
+	if err != nil || len(matchLabels) == 0 {
+		return err
+	}
+	labels, _, err := unstructured.NestedStringMap(obj.Object, "spec", "template", "metadata", "labels")
+	if err != nil {
+		return err
+	}
+	liveLabels, _, err := unstructured.NestedStringMap(live.Object, "spec", "template", "metadata", "labels")
+	if err != nil {
+		return err
+	}
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for k := range matchLabels {
+		if _, ok := labels[k]; ok {
+			continue
+		}
+		if v, ok := liveLabels[k]; ok {
+			labels[k] = v
+		}
+	}
+	return unstructured.SetNestedStringMap(obj.Object, labels, "spec", "template", "metadata", "labels")
+}
+
+// preserveScaledReplicas keeps the replicas when the object is scaled by a HorizontalPodAutoscaler.
+func preserveScaledReplicas(
+	ctx context.Context,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	live, obj *unstructured.Unstructured,
+) error {
+	restMapping, err := mapping.RESTMapping(schema.GroupKind{Group: "autoscaling", Kind: "HorizontalPodAutoscaler"})
+	if err != nil {
+		if meta.IsNoMatchError(err) {
+			return nil
+		}
+		return err
+	}
+	list, err := dynamicClient.Resource(restMapping.Resource).
+		Namespace(obj.GetNamespace()).
+		List(ctx, metav1.ListOptions{})
+	if apierrors.IsForbidden(err) || apierrors.IsNotFound(err) {
+		// the service account may not be allowed to list HorizontalPodAutoscalers, treat it as no HPA.
+		logrus.WithField("kind", obj.GetKind()).
+			WithField("namespace", obj.GetNamespace()).
+			WithField("name", obj.GetName()).
+			Debugf("Skip preserving replicas, list HorizontalPodAutoscalers failed: %v", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("list HorizontalPodAutoscalers failed: %v", err)
+	}
+
+	gv := obj.GroupVersionKind().GroupVersion()
+	for _, item := range list.Items {
+		ref, _, _ := unstructured.NestedStringMap(item.Object, "spec", "scaleTargetRef")
+		if ref["kind"] != obj.GetKind() || ref["name"] != obj.GetName() {
+			continue
+		}
+		if refGV, err := schema.ParseGroupVersion(ref["apiVersion"]); err == nil && refGV.Group != gv.Group {
+			continue
+		}
+		logrus.WithField("kind", obj.GetKind()).
+			WithField("name", obj.GetName()).
+			WithField("hpa", item.GetName()).
+			Debug("Preserve replicas managed by HorizontalPodAutoscaler")
+		return copyNestedField(live, obj, "spec", "replicas")
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	pkgruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+)
+
+func TestPreserveScaledReplicas(t *testing.T) {
+	hpaGVR := schema.GroupVersionResource{Group: "autoscaling", Version: "v2", Resource: "horizontalpodautoscalers"}
+	mapping := meta.NewDefaultRESTMapper([]schema.GroupVersion{hpaGVR.GroupVersion()})
+	mapping.Add(hpaGVR.GroupVersion().WithKind("HorizontalPodAutoscaler"), meta.RESTScopeNamespace)
+
+	newDeployment := func(replicas int64) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		obj.SetAPIVersion("apps/v1")
+		obj.SetKind("Deployment")
+		obj.SetNamespace("default")
+		obj.SetName("app")
+		_ = unstructured.SetNestedField(obj.Object, replicas, "spec", "replicas")
+		return obj
+	}
+	hpa := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "autoscaling/v2",
+		"kind":       "HorizontalPodAutoscaler",
+		"metadata":   map[string]interface{}{"namespace": "default", "name": "app"},
+		"spec": map[string]interface{}{
+			"scaleTargetRef": map[string]interface{}{"apiVersion": "apps/v1", "kind": "Deployment", "name": "app"},
+		},
+	}}
+
+	tests := []struct {
+		name    string
+		objects []pkgruntime.Object
+		listErr error
+		want    int64
+		wantErr bool
+	}{
+		{name: "no hpa", want: 1},
+		{name: "scaled by hpa", objects: []pkgruntime.Object{hpa}, want: 5},
+		{
+			name:    "list forbidden",
+			listErr: apierrors.NewForbidden(hpaGVR.GroupResource(), "", nil),
+			want:    1,
+		},
+		{
+			name:    "list not found",
+			listErr: apierrors.NewNotFound(hpaGVR.GroupResource(), ""),
+			want:    1,
+		},
+		{
+			name:    "list failed",
+			listErr: apierrors.NewInternalError(errors.New("etcd unavailable")),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(pkgruntime.NewScheme(),
+				map[schema.GroupVersionResource]string{hpaGVR: "HorizontalPodAutoscalerList"}, tt.objects...)
+			if tt.listErr != nil {
+				dynamicClient.PrependReactor("list", "horizontalpodautoscalers",
+					func(action clienttesting.Action) (bool, pkgruntime.Object, error) {
+						return true, nil, tt.listErr
+					})
+			}
+
+			live, obj := newDeployment(5), newDeployment(1)
+			err := preserveScaledReplicas(context.Background(), dynamicClient, mapping, live, obj)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("preserveScaledReplicas() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got, _, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas"); got != tt.want {
+				t.Errorf("replicas = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFieldPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []string
+		wantErr bool
+	}{
+		{path: ".spec.replicas", want: []string{"spec", "replicas"}},
+		{path: "spec.replicas", want: []string{"spec", "replicas"}},
+		{
+			path: ".metadata.annotations['deployment.kubernetes.io/revision']",
+			want: []string{"metadata", "annotations", "deployment.kubernetes.io/revision"},
+		},
+		{
+			path: `.metadata.annotations["example.com/a"].b`,
+			want: []string{"metadata", "annotations", "example.com/a", "b"},
+		},
+		{
+			path: `.metadata.annotations.deployment\.kubernetes\.io/revision`,
+			want: []string{"metadata", "annotations", "deployment.kubernetes.io/revision"},
+		},
+		{path: ".metadata.labels['a']['b']", want: []string{"metadata", "labels", "a", "b"}},
+		{path: "", wantErr: true},
+		{path: ".", wantErr: true},
+		{path: ".spec..replicas", wantErr: true},
+		{path: ".spec.", wantErr: true},
+		{path: ".spec[replicas]", wantErr: true},
+		{path: ".spec['replicas'", wantErr: true},
+		{path: ".spec['']", wantErr: true},
+		{path: ".spec['a']b", wantErr: true},
+		{path: `.spec\`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := parseFieldPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFieldPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseFieldPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustObject(t *testing.T, data string) *unstructured.Unstructured {
+	t.Helper()
+	objs, err := kube.ParseObject([]byte(data))
+	if err != nil || len(objs) != 1 {
+		t.Fatalf("ParseObject() = %d objects, error = %v", len(objs), err)
+	}
+	return &objs[0]
+}
+
+func TestPreserveNodePorts(t *testing.T) {
+	live := `
+apiVersion: v1
+kind: Service
+spec:
+  type: NodePort
+  healthCheckNodePort: 30100
+  ports:
+  - {port: 80, protocol: TCP, nodePort: 30080}
+  - {port: 53, protocol: UDP, nodePort: 30053}
+  - {port: 53, nodePort: 30054}
+`
+	tests := []struct {
+		name string
+		obj  string
+		want string
+	}{
+		{
+			name: "omitted node ports by port and protocol",
+			obj: `
+apiVersion: v1
+kind: Service
+spec:
+  type: NodePort
+  ports:
+  - {port: 80}
+  - {port: 53, protocol: UDP}
+  - {port: 53, protocol: TCP}
+  - {port: 443}
+`,
+			want: `
+apiVersion: v1
+kind: Service
+spec:
+  type: NodePort
+  healthCheckNodePort: 30100
+  ports:
+  - {port: 80, nodePort: 30080}
+  - {port: 53, protocol: UDP, nodePort: 30053}
+  - {port: 53, protocol: TCP, nodePort: 30054}
+  - {port: 443}
+`,
+		},
+		{
+			name: "defined node ports",
+			obj: `
+apiVersion: v1
+kind: Service
+spec:
+  type: LoadBalancer
+  healthCheckNodePort: 30200
+  ports:
+  - {port: 80, nodePort: 31080}
+`,
+			want: `
+apiVersion: v1
+kind: Service
+spec:
+  type: LoadBalancer
+  healthCheckNodePort: 30200
+  ports:
+  - {port: 80, nodePort: 31080}
+`,
+		},
+		{
+			name: "cluster ip",
+			obj: `
+apiVersion: v1
+kind: Service
+spec:
+  type: ClusterIP
+  ports:
+  - {port: 80}
+`,
+			want: `
+apiVersion: v1
+kind: Service
+spec:
+  type: ClusterIP
+  ports:
+  - {port: 80}
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := mustObject(t, tt.obj)
+			if err := preserveNodePorts(context.Background(), nil, nil, mustObject(t, live), obj); err != nil {
+				t.Fatalf("preserveNodePorts() error = %v", err)
+			}
+			if want := mustObject(t, tt.want); !reflect.DeepEqual(obj.Object, want.Object) {
+				t.Errorf("preserveNodePorts() = %v, want %v", obj.Object, want.Object)
+			}
+		})
+	}
+}
+
+func TestPreserveJobSelector(t *testing.T) {
+	live := mustObject(t, `
+apiVersion: batch/v1
+kind: Job
+spec:
+  selector:
+    matchLabels: {controller-uid: abc}
+  template:
+    metadata:
+      labels: {app: migrate, controller-uid: abc, job-name: migrate}
+`)
+	tests := []struct {
+		name string
+		obj  string
+		want string
+	}{
+		{
+			name: "generated selector",
+			obj: `
+apiVersion: batch/v1
+kind: Job
+spec:
+  template:
+    metadata:
+      labels: {app: migrate}
+`,
+			want: `
+apiVersion: batch/v1
+kind: Job
+spec:
+  selector:
+    matchLabels: {controller-uid: abc}
+  template:
+    metadata:
+      labels: {app: migrate, controller-uid: abc}
+`,
+		},
+		{
+			name: "defined selector",
+			obj: `
+apiVersion: batch/v1
+kind: Job
+spec:
+  manualSelector: true
+  selector:
+    matchLabels: {app: migrate}
+  template:
+    metadata:
+      labels: {app: migrate}
+`,
+			want: `
+apiVersion: batch/v1
+kind: Job
+spec:
+  manualSelector: true
+  selector:
+    matchLabels: {app: migrate}
+  template:
+    metadata:
+      labels: {app: migrate}
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := mustObject(t, tt.obj)
+			if err := preserveJobSelector(context.Background(), nil, nil, live, obj); err != nil {
+				t.Fatalf("preserveJobSelector() error = %v", err)
+			}
+			if want := mustObject(t, tt.want); !reflect.DeepEqual(obj.Object, want.Object) {
+				t.Errorf("preserveJobSelector() = %v, want %v", obj.Object, want.Object)
+			}
+		})
+	}
+}
+
+func TestPreserveVolumeName(t *testing.T) {
+	live := mustObject(t, "apiVersion: v1\nkind: PersistentVolumeClaim\nspec: {volumeName: pv-1}")
+	tests := []struct {
+		name string
+		obj  string
+		want string
+	}{
+		{name: "omitted", obj: "spec: {}", want: "pv-1"},
+		{name: "defined", obj: "spec: {volumeName: pv-2}", want: "pv-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := mustObject(t, "apiVersion: v1\nkind: PersistentVolumeClaim\n"+tt.obj)
+			if err := preserveVolumeName(context.Background(), nil, nil, live, obj); err != nil {
+				t.Fatalf("preserveVolumeName() error = %v", err)
+			}
+			if got, _, _ := unstructured.NestedString(obj.Object, "spec", "volumeName"); got != tt.want {
+				t.Errorf("volumeName = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreserveFields_Rules(t *testing.T) {
+	live := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations: {deployment.kubernetes.io/revision: "3", owner: team-a}
+spec:
+  replicas: 5
+  paused: true
+`
+	obj := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations: {owner: team-b}
+spec:
+  replicas: 1
+`
+	tests := []struct {
+		name  string
+		rules []PreserveRule
+		want  string
+	}{
+		{
+			name: "no rules",
+			want: obj,
+		},
+		{
+			name: "matched rule",
+			rules: []PreserveRule{{
+				Kind:  "Deployment",
+				Paths: []string{".spec.replicas", ".spec.missing", ".metadata.annotations['deployment.kubernetes.io/revision']"},
+			}},
+			want: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations: {deployment.kubernetes.io/revision: "3", owner: team-b}
+spec:
+  replicas: 5
+`,
+		},
+		{
+			name:  "matched api version",
+			rules: []PreserveRule{{APIVersion: "apps/v1", Kind: "Deployment", Paths: []string{".spec.paused"}}},
+			want: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations: {owner: team-b}
+spec:
+  replicas: 1
+  paused: true
+`,
+		},
+		{
+			name: "other api version and kind",
+			rules: []PreserveRule{
+				{APIVersion: "apps/v1beta1", Kind: "Deployment", Paths: []string{".spec.replicas"}},
+				{Kind: "StatefulSet", Paths: []string{".spec.replicas"}},
+			},
+			want: obj,
+		},
+	}
+	mapping := meta.NewDefaultRESTMapper(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := mustObject(t, obj)
+			err := preserveFields(context.Background(), nil, mapping, tt.rules, mustObject(t, live), current)
+			if err != nil {
+				t.Fatalf("preserveFields() error = %v", err)
+			}
+			if want := mustObject(t, tt.want); !reflect.DeepEqual(current.Object, want.Object) {
+				t.Errorf("preserveFields() = %v, want %v", current.Object, want.Object)
+			}
+		})
+	}
+}
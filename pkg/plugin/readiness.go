@@ -0,0 +1,239 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+)
+
+// ReadinessRule defines how the readiness of a kind is evaluated,
+// either by a condition in `status.conditions` or by the value of a field.
+type ReadinessRule struct {
+	// APIVersion is optional, all versions of the kind are matched if it is empty.
+	APIVersion string `json:"api_version"`
+	Kind       string `json:"kind"`
+
+	// ConditionType is the type of condition, e.g. `Ready`.
+	ConditionType string `json:"condition_type"`
+	// ConditionStatus is the expected status of condition, defaults to `True`.
+	ConditionStatus string `json:"condition_status"`
+
+	// Path is the JSONPath expression evaluated on the object, e.g. `.status.phase`.
+	Path string `json:"path"`
+	// Value is the expected value of Path.
+	Value string `json:"value"`
+}
+
+func (r *ReadinessRule) Validate() error {
+	if r.Kind == "" {
+		return errors.New("kind must be defined")
+	}
+	if (r.ConditionType == "") == (r.Path == "") {
+		return errors.New("one of condition_type and path must be defined")
+	}
+	if r.Path != "" {
+		if _, err := parseJSONPath(r.Kind, r.Path); err != nil {
+			return err
+		}
+	}
+	if r.ConditionType != "" && r.ConditionStatus == "" {
+		r.ConditionStatus = "True"
+	}
+	return nil
+}
+
+func (r *ReadinessRule) Match(apiVersion, kind string) bool {
+	return matchKind(r.APIVersion, r.Kind, apiVersion, kind)
+}
+
+// matchKind reports whether the object of apiVersion and kind is selected by the rule of ruleAPIVersion and ruleKind,
+// all versions of the kind are matched if ruleAPIVersion is empty.
+func matchKind(ruleAPIVersion, ruleKind, apiVersion, kind string) bool {
+	if ruleKind != kind {
+		return false
+	}
+	return ruleAPIVersion == "" || ruleAPIVersion == apiVersion
+}
+
+// Check reports whether obj is ready, the message describes why it is not ready.
+// The status observed for the previous generations is regarded as not ready,
+// since the controller has not reconciled the latest changes yet.
+func (r *ReadinessRule) Check(obj *unstructured.Unstructured) (bool, string, error) {
+	generation := obj.GetGeneration()
+	observedGeneration, found, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+	if found && observedGeneration < generation {
+		return false, fmt.Sprintf("waiting for generation %d to be observed", generation), nil
+	}
+
+	if r.ConditionType != "" {
+		condition, ok := kube.FindCondition(obj, r.ConditionType)
+		if !ok {
+			return false, fmt.Sprintf("condition %s is not found", r.ConditionType), nil
+		}
+		if condition.ObservedGeneration > 0 && condition.ObservedGeneration < generation {
+			return false, fmt.Sprintf("waiting for condition %s of generation %d", condition.Type, generation), nil
+		}
+		if condition.Status == r.ConditionStatus {
+			return true, "", nil
+		}
+		message := fmt.Sprintf("condition %s is %s", condition.Type, condition.Status)
+		if condition.Reason != "" {
+			message += ", reason: " + condition.Reason
+		}
+		if condition.Message != "" {
+			message += ", message: " + condition.Message
+		}
+		return false, message, nil
+	}
+
+	jp, err := parseJSONPath(r.Kind, r.Path)
+	if err != nil {
+		return false, "", err
+	}
+	jp.AllowMissingKeys(true)
+	var buf bytes.Buffer
+	if err := jp.Execute(&buf, obj.Object); err != nil {
+		return false, "", err
+	}
+	if value := buf.String(); value != r.Value {
+		return false, fmt.Sprintf("%s is %q, expected %q", r.Path, value, r.Value), nil
+	}
+	return true, "", nil
+}
+
+type readinessCheck func(obj *unstructured.Unstructured) (bool, string, error)
+
+func findReadinessCheck(cfg *Config, apiVersion, kind string) readinessCheck {
+	for i := range cfg.Readiness {
+		if rule := &cfg.Readiness[i]; rule.Match(apiVersion, kind) {
+			return rule.Check
+		}
+	}
+	if cfg.WaitRollout && kube.IsWorkload(kind) {
+		return kube.WorkloadReady
+	}
+	return nil
+}
+
+// waitReadiness waits until the applied objects matching the readiness rules are ready.
+func waitReadiness(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	report *Report,
+	cfg *Config,
+) error {
+	eg := new(errgroup.Group)
+	for i, item := range report.List() {
+		if item.Action == ActionFailed || item.Hook != "" {
+			continue
+		}
+		check := findReadinessCheck(cfg, item.APIVersion, item.Kind)
+		if check == nil {
+			continue
+		}
+
+		i, item := i, item
+		eg.Go(func() error {
+			last, err := waitReady(ctx, dynamicClient, mapping, item, check, cfg.WaitTimeout, cfg.RequestTimeout)
+			report.Update(i, func(item *ReportItem) {
+				ready := err == nil
+				item.Ready = &ready
+			})
+			if err != nil && last != nil {
+				diagnoseCtx, cancel := context.WithTimeout(context.Background(), diagnoseTimeout)
+				diagnoseWorkload(diagnoseCtx, kubeClient, last, cfg.FailureLogLines)
+				cancel()
+			}
+			return err
+		})
+	}
+	return eg.Wait()
+}
+
+// waitReady waits until the object is ready, and returns the last observed object,
+// each request is bounded by requestTimeout.
+func waitReady(
+	ctx context.Context,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	item ReportItem,
+	check readinessCheck,
+	timeout time.Duration,
+	requestTimeout time.Duration,
+) (*unstructured.Unstructured, error) {
+	gv, err := schema.ParseGroupVersion(item.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+	resourceInter, _, err := newResourceInterface(dynamicClient, mapping, gv.WithKind(item.Kind), item.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	log := logrus.WithField("kind", item.Kind).
+		WithField("namespace", item.Namespace).
+		WithField("name", item.Name)
+	log.Info("Wait for readiness")
+
+	var (
+		last    *unstructured.Unstructured
+		message string
+	)
+	err = wait.PollImmediateWithContext(ctx, waitInterval, timeout, func(ctx context.Context) (bool, error) {
+		obj, err := getWithTimeout(ctx, resourceInter, item.Name, requestTimeout)
+		if err != nil {
+			return false, err
+		}
+		last = obj
+
+		ready, current, err := check(obj)
+		if err != nil {
+			return false, err
+		}
+		if !ready && current != message {
+			log.Info(current)
+		}
+		message = current
+		return ready, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return last, fmt.Errorf("%s %s is not ready after %s: %s",
+			item.Kind, strings.TrimPrefix(item.Namespace+"/"+item.Name, "/"), timeout, message)
+	}
+	if err != nil {
+		return last, fmt.Errorf("%s %s is not ready: %v",
+			item.Kind, strings.TrimPrefix(item.Namespace+"/"+item.Name, "/"), err)
+	}
+	log.Info("Resource is ready")
+	return last, nil
+}
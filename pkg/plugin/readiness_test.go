@@ -0,0 +1,166 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+)
+
+func TestReadinessRule_Check(t *testing.T) {
+	conditionRule := ReadinessRule{Kind: "Certificate", ConditionType: "Ready"}
+	pathRule := ReadinessRule{Kind: "Certificate", Path: ".status.phase", Value: "Issued"}
+
+	tests := []struct {
+		name        string
+		rule        ReadinessRule
+		data        string
+		want        bool
+		wantMessage string
+	}{
+		{
+			name: "condition ready",
+			rule: conditionRule,
+			data: `
+metadata: {generation: 2}
+status:
+  observedGeneration: 2
+  conditions: [{type: Ready, status: "True", observedGeneration: 2}]
+`,
+			want: true,
+		},
+		{
+			name:        "condition not found",
+			rule:        conditionRule,
+			data:        "status: {conditions: []}",
+			wantMessage: "condition Ready is not found",
+		},
+		{
+			name: "condition not ready",
+			rule: conditionRule,
+			data: `
+status:
+  conditions: [{type: Ready, status: "False", reason: Pending, message: issuing}]
+`,
+			wantMessage: "condition Ready is False, reason: Pending, message: issuing",
+		},
+		{
+			name: "condition status of custom value",
+			rule: ReadinessRule{Kind: "Certificate", ConditionType: "Issuing", ConditionStatus: "False"},
+			data: `
+status:
+  conditions: [{type: Issuing, status: "False"}]
+`,
+			want: true,
+		},
+		{
+			name: "status of previous generation",
+			rule: conditionRule,
+			data: `
+metadata: {generation: 2}
+status:
+  observedGeneration: 1
+  conditions: [{type: Ready, status: "True"}]
+`,
+			wantMessage: "waiting for generation 2 to be observed",
+		},
+		{
+			name: "condition of previous generation",
+			rule: conditionRule,
+			data: `
+metadata: {generation: 2}
+status:
+  conditions: [{type: Ready, status: "True", observedGeneration: 1}]
+`,
+			wantMessage: "waiting for condition Ready of generation 2",
+		},
+		{
+			name: "condition without generations",
+			rule: conditionRule,
+			data: `
+metadata: {generation: 2}
+status:
+  conditions: [{type: Ready, status: "True"}]
+`,
+			want: true,
+		},
+		{
+			name: "path matched",
+			rule: pathRule,
+			data: "status: {phase: Issued}",
+			want: true,
+		},
+		{
+			name:        "path not matched",
+			rule:        pathRule,
+			data:        "status: {phase: Pending}",
+			wantMessage: `.status.phase is "Pending", expected "Issued"`,
+		},
+		{
+			name:        "path missing",
+			rule:        pathRule,
+			data:        "status: {}",
+			wantMessage: `.status.phase is "", expected "Issued"`,
+		},
+		{
+			name:        "path of previous generation",
+			rule:        pathRule,
+			data:        "metadata: {generation: 3}\nstatus: {observedGeneration: 2, phase: Issued}",
+			wantMessage: "waiting for generation 3 to be observed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := tt.rule
+			if err := rule.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			objs, err := kube.ParseObject([]byte("apiVersion: cert-manager.io/v1\nkind: Certificate\n" + tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, message, err := rule.Check(&objs[0])
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if got != tt.want || message != tt.wantMessage {
+				t.Errorf("Check() = %v, %q, want %v, %q", got, message, tt.want, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestReadinessRule_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    ReadinessRule
+		wantErr bool
+	}{
+		{name: "condition", rule: ReadinessRule{Kind: "Certificate", ConditionType: "Ready"}},
+		{name: "path", rule: ReadinessRule{Kind: "Certificate", Path: "status.phase", Value: "Issued"}},
+		{name: "no kind", rule: ReadinessRule{ConditionType: "Ready"}, wantErr: true},
+		{name: "neither", rule: ReadinessRule{Kind: "Certificate"}, wantErr: true},
+		{name: "both", rule: ReadinessRule{Kind: "Certificate", ConditionType: "Ready", Path: ".status.phase"}, wantErr: true},
+		{name: "invalid path", rule: ReadinessRule{Kind: "Certificate", Path: "{.status[}"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,431 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	pkgruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/constants"
+)
+
+const (
+	defaultHistoryMax = 10
+
+	releaseStorageSecret    = "secret"
+	releaseStorageConfigMap = "configmap"
+
+	releaseDataKey = "release"
+)
+
+const (
+	labelRelease  = constants.AnnotationPrefix + "release"
+	labelRevision = constants.AnnotationPrefix + "revision"
+)
+
+// History defines where the release revisions are stored.
+type History struct {
+	// Name is the release name, the history is disabled if it is empty.
+	Name string `json:"name"`
+	// Namespace is the namespace to store revisions, defaults to `namespace`.
+	Namespace string `json:"namespace"`
+	// Max is the number of revisions to keep, defaults to 10.
+	Max int `json:"max"`
+	// Storage is `secret` (default) or `configmap`,
+	// the Secrets are not recorded in ConfigMaps since the manifests are stored in plain text.
+	Storage string `json:"storage"`
+}
+
+// Release is a revision of the applied manifests.
+type Release struct {
+	Name        string    `json:"name"`
+	Revision    int       `json:"revision"`
+	Build       string    `json:"build,omitempty"`
+	Commit      string    `json:"commit,omitempty"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Namespace is the default namespace of the manifests.
+	Namespace string `json:"namespace,omitempty"`
+	// Manifests are the applied objects, grouped in the order they are applied.
+	Manifests [][]map[string]interface{} `json:"manifests"`
+}
+
+func (r *Release) ObjectSet() [][]unstructured.Unstructured {
+	objSet := make([][]unstructured.Unstructured, 0, len(r.Manifests))
+	for _, manifests := range r.Manifests {
+		objs := make([]unstructured.Unstructured, 0, len(manifests))
+		for _, v := range manifests {
+			objs = append(objs, unstructured.Unstructured{Object: v})
+		}
+		objSet = append(objSet, objs)
+	}
+	return objSet
+}
+
+func newManifests(objSets ...[][]unstructured.Unstructured) [][]map[string]interface{} {
+	var manifests [][]map[string]interface{}
+	for _, objSet := range objSets {
+		for _, objs := range objSet {
+			if len(objs) == 0 {
+				continue
+			}
+			current := make([]map[string]interface{}, 0, len(objs))
+			for _, obj := range objs {
+				current = append(current, obj.DeepCopy().Object)
+			}
+			manifests = append(manifests, current)
+		}
+	}
+	return manifests
+}
+
+func configMapsToObjectSet(cms []*v1.ConfigMap) ([][]unstructured.Unstructured, error) {
+	if len(cms) == 0 {
+		return nil, nil
+	}
+	objs := make([]unstructured.Unstructured, 0, len(cms))
+	for _, cm := range cms {
+		current := cm.DeepCopy()
+		current.ResourceVersion = ""
+		content, err := pkgruntime.DefaultUnstructuredConverter.ToUnstructured(current)
+		if err != nil {
+			return nil, err
+		}
+		obj := unstructured.Unstructured{Object: content}
+		unstructured.RemoveNestedField(obj.Object, "metadata", "creationTimestamp")
+		objs = append(objs, obj)
+	}
+	return [][]unstructured.Unstructured{objs}, nil
+}
+
+type releaseStore struct {
+	kubeClient kubernetes.Interface
+	history    *History
+	// timeout bounds each request to the storage.
+	timeout time.Duration
+}
+
+func newReleaseStore(kubeClient kubernetes.Interface, history *History, timeout time.Duration) *releaseStore {
+	return &releaseStore{kubeClient: kubeClient, history: history, timeout: timeout}
+}
+
+func (s *releaseStore) objectName(revision int) string {
+	return fmt.Sprintf("%s.v%d", s.history.Name, revision)
+}
+
+func (s *releaseStore) selector() string {
+	return labels.SelectorFromSet(labels.Set{labelRelease: s.history.Name}).String()
+}
+
+// List returns the revisions in ascending order.
+func (s *releaseStore) List(ctx context.Context) ([]*Release, error) {
+	var dataSet []string
+	listOptions := metav1.ListOptions{LabelSelector: s.selector()}
+	err := callWithTimeout(ctx, s.timeout, func(ctx context.Context) error {
+		switch s.history.Storage {
+		case releaseStorageConfigMap:
+			list, err := s.kubeClient.CoreV1().ConfigMaps(s.history.Namespace).List(ctx, listOptions)
+			if err != nil {
+				return err
+			}
+			for _, item := range list.Items {
+				dataSet = append(dataSet, item.Data[releaseDataKey])
+			}
+		default:
+			list, err := s.kubeClient.CoreV1().Secrets(s.history.Namespace).List(ctx, listOptions)
+			if err != nil {
+				return err
+			}
+			for _, item := range list.Items {
+				dataSet = append(dataSet, string(item.Data[releaseDataKey]))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	releases := make([]*Release, 0, len(dataSet))
+	for _, data := range dataSet {
+		release, err := decodeRelease(data)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].Revision < releases[j].Revision
+	})
+	return releases, nil
+}
+
+// Create stores the release as the next revision, and prunes the revisions exceeding the max.
+func (s *releaseStore) Create(ctx context.Context, release *Release) error {
+	releases, err := s.List(ctx)
+	if err != nil {
+		return err
+	}
+	if s.history.Storage == releaseStorageConfigMap {
+		var skipped int
+		release.Manifests, skipped = withoutSecrets(release.Manifests)
+		if skipped > 0 {
+			logrus.WithField("release", s.history.Name).
+				Warnf("Skip recording %d Secrets, they are not stored in the ConfigMap storage", skipped)
+		}
+	}
+	release.Name = s.history.Name
+	release.Revision = 1
+	if len(releases) > 0 {
+		release.Revision = releases[len(releases)-1].Revision + 1
+	}
+
+	data, err := encodeRelease(release)
+	if err != nil {
+		return err
+	}
+	meta := metav1.ObjectMeta{
+		Name:      s.objectName(release.Revision),
+		Namespace: s.history.Namespace,
+		Labels: map[string]string{
+			labelRelease:  s.history.Name,
+			labelRevision: strconv.Itoa(release.Revision),
+		},
+	}
+	err = callWithTimeout(ctx, s.timeout, func(ctx context.Context) error {
+		var err error
+		switch s.history.Storage {
+		case releaseStorageConfigMap:
+			_, err = s.kubeClient.CoreV1().ConfigMaps(s.history.Namespace).Create(ctx, &v1.ConfigMap{
+				ObjectMeta: meta,
+				Data:       map[string]string{releaseDataKey: data},
+			}, metav1.CreateOptions{})
+		default:
+			_, err = s.kubeClient.CoreV1().Secrets(s.history.Namespace).Create(ctx, &v1.Secret{
+				ObjectMeta: meta,
+				Type:       v1.SecretType(constants.AnnotationPrefix + "release.v1"),
+				Data:       map[string][]byte{releaseDataKey: []byte(data)},
+			}, metav1.CreateOptions{})
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("store release %s revision %d failed: %v", release.Name, release.Revision, err)
+	}
+
+	releases = append(releases, release)
+	for i := 0; i < len(releases)-s.history.Max; i++ {
+		name := s.objectName(releases[i].Revision)
+		err = callWithTimeout(ctx, s.timeout, func(ctx context.Context) error {
+			if s.history.Storage == releaseStorageConfigMap {
+				return s.kubeClient.CoreV1().ConfigMaps(s.history.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+			}
+			return s.kubeClient.CoreV1().Secrets(s.history.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		})
+		if err != nil {
+			logrus.Warnf("Prune release %s revision %d failed: %v", release.Name, releases[i].Revision, err)
+		}
+	}
+	return nil
+}
+
+// withoutSecrets returns the manifests without Secrets, and the number of Secrets removed.
+func withoutSecrets(manifests [][]map[string]interface{}) ([][]map[string]interface{}, int) {
+	var (
+		result  [][]map[string]interface{}
+		skipped int
+	)
+	for _, objs := range manifests {
+		current := make([]map[string]interface{}, 0, len(objs))
+		for _, obj := range objs {
+			if obj["apiVersion"] == "v1" && obj["kind"] == "Secret" {
+				skipped++
+				continue
+			}
+			current = append(current, obj)
+		}
+		if len(current) > 0 {
+			result = append(result, current)
+		}
+	}
+	return result, skipped
+}
+
+func encodeRelease(release *Release) (string, error) {
+	b, err := json.Marshal(release)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decodeRelease(data string) (*Release, error) {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode release failed: %v", err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("decode release failed: %v", err)
+	}
+	defer r.Close()
+
+	release := &Release{}
+	if err := json.NewDecoder(r).Decode(release); err != nil {
+		return nil, fmt.Errorf("decode release failed: %v", err)
+	}
+	return release, nil
+}
+
+// recordRelease stores the applied manifests as a new revision.
+func recordRelease(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	cfg *Config,
+	envMap map[string]string,
+	description string,
+	manifests [][]map[string]interface{},
+) error {
+	release := &Release{
+		Build:       envMap["DRONE_BUILD_NUMBER"],
+		Commit:      envMap["DRONE_COMMIT_SHA"],
+		Description: description,
+		CreatedAt:   time.Now(),
+		Namespace:   cfg.Namespace,
+		Manifests:   manifests,
+	}
+	if err := newReleaseStore(kubeClient, &cfg.History, cfg.RequestTimeout).Create(ctx, release); err != nil {
+		return err
+	}
+	logrus.WithField("namespace", cfg.History.Namespace).
+		WithField("release", release.Name).
+		WithField("revision", release.Revision).
+		Info("Release recorded")
+	return nil
+}
+
+// history prints the revisions of the release.
+func history(ctx context.Context, cfg *Config, kubeClient kubernetes.Interface, out io.Writer) error {
+	if cfg.History.Name == "" {
+		return errors.New("history name must be defined")
+	}
+	releases, err := newReleaseStore(kubeClient, &cfg.History, cfg.RequestTimeout).List(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REVISION\tBUILD\tCOMMIT\tCREATED\tDESCRIPTION")
+	for _, release := range releases {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n",
+			release.Revision, release.Build, release.Commit, release.CreatedAt.Format(time.RFC3339), release.Description)
+	}
+	return w.Flush()
+}
+
+// rollback re-applies the manifests of the revision, and records them as a new revision.
+// If revision is 0, the previous revision is used.
+func rollback(
+	ctx context.Context,
+	cfg *Config,
+	kubeClient kubernetes.Interface,
+	dynamicClient dynamic.Interface,
+	envMap map[string]string,
+	revision int,
+) (err error) {
+	if cfg.History.Name == "" {
+		return errors.New("history name must be defined")
+	}
+	releases, err := newReleaseStore(kubeClient, &cfg.History, cfg.RequestTimeout).List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var target *Release
+	if revision == 0 {
+		if len(releases) < 2 {
+			return fmt.Errorf("release %s has no previous revision", cfg.History.Name)
+		}
+		target = releases[len(releases)-2]
+	}
+	for _, release := range releases {
+		if release.Revision == revision {
+			target = release
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("release %s revision %d is not found", cfg.History.Name, revision)
+	}
+
+	report := NewReport(cfg.redactor)
+	defer func() {
+		report.Finish(err)
+		if cfg.ReportPath == "" {
+			return
+		}
+		if writeErr := report.WriteFile(cfg.ReportPath); writeErr != nil {
+			logrus.Errorf("write report to %s failed: %v", cfg.ReportPath, writeErr)
+		}
+	}()
+
+	mapping := newRESTMapper(kubeClient)
+
+	if cfg.Lock.Key != "" {
+		lock, lockCtx, err := acquireLock(ctx, kubeClient, &cfg.Lock, lockIdentity(envMap), cfg.RequestTimeout)
+		if err != nil {
+			return err
+		}
+		ctx = lockCtx
+		defer func() {
+			lock.Release()
+			err = lockError(lock, err)
+		}()
+	}
+
+	logrus.WithField("release", target.Name).
+		WithField("revision", target.Revision).
+		Info("Rollback")
+	if err := applyResources(ctx, dynamicClient, mapping, target.ObjectSet(), cfg, target.Namespace, report); err != nil {
+		return err
+	}
+	return recordRelease(ctx, kubeClient, cfg, envMap, fmt.Sprintf("Rollback to %d", target.Revision), target.Manifests)
+}
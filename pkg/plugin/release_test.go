@@ -0,0 +1,204 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	pkgruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newReleaseManifest(kind, name, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": name},
+		"data":       map[string]interface{}{"value": value},
+	}
+}
+
+func TestEncodeRelease(t *testing.T) {
+	release := &Release{
+		Name:        "app",
+		Revision:    3,
+		Build:       "42",
+		Commit:      "abc",
+		Description: "Rollback to 1",
+		CreatedAt:   time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC),
+		Namespace:   "default",
+		Manifests:   [][]map[string]interface{}{{newReleaseManifest("ConfigMap", "app", "v1")}},
+	}
+	data, err := encodeRelease(release)
+	if err != nil {
+		t.Fatalf("encodeRelease() error = %v", err)
+	}
+	got, err := decodeRelease(data)
+	if err != nil {
+		t.Fatalf("decodeRelease() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, release) {
+		t.Errorf("decodeRelease() = %+v, want %+v", got, release)
+	}
+
+	for _, data := range []string{"not base64!", "bm90IGd6aXA="} {
+		if _, err := decodeRelease(data); err == nil {
+			t.Errorf("decodeRelease(%q) error = nil, want error", data)
+		}
+	}
+}
+
+func TestReleaseStore_Create(t *testing.T) {
+	tests := []struct {
+		storage string
+	}{
+		{storage: releaseStorageSecret},
+		{storage: releaseStorageConfigMap},
+	}
+	for _, tt := range tests {
+		t.Run(tt.storage, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset()
+			store := newReleaseStore(kubeClient, &History{Name: "app", Namespace: "default", Max: 2, Storage: tt.storage}, time.Second)
+
+			for i := 0; i < 3; i++ {
+				release := &Release{Manifests: [][]map[string]interface{}{{
+					newReleaseManifest("ConfigMap", "app", "value"),
+					newReleaseManifest("Secret", "app", "c2VjcmV0"),
+				}}}
+				if err := store.Create(context.Background(), release); err != nil {
+					t.Fatalf("Create() error = %v", err)
+				}
+				if release.Revision != i+1 {
+					t.Errorf("Create() revision = %d, want %d", release.Revision, i+1)
+				}
+			}
+
+			releases, err := store.List(context.Background())
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			var revisions []int
+			for _, release := range releases {
+				revisions = append(revisions, release.Revision)
+			}
+			if want := []int{2, 3}; !reflect.DeepEqual(revisions, want) {
+				t.Errorf("List() revisions = %v, want %v", revisions, want)
+			}
+
+			wantObjects := 2
+			if tt.storage == releaseStorageConfigMap {
+				// the Secrets are not stored in plain text
+				wantObjects = 1
+			}
+			if got := len(releases[1].Manifests[0]); got != wantObjects {
+				t.Errorf("recorded objects = %d, want %d", got, wantObjects)
+			}
+
+			var names []string
+			if tt.storage == releaseStorageConfigMap {
+				list, _ := kubeClient.CoreV1().ConfigMaps("default").List(context.Background(), metav1.ListOptions{})
+				for _, item := range list.Items {
+					names = append(names, item.Name)
+				}
+			} else {
+				list, _ := kubeClient.CoreV1().Secrets("default").List(context.Background(), metav1.ListOptions{})
+				for _, item := range list.Items {
+					names = append(names, item.Name)
+				}
+			}
+			if want := []string{"app.v2", "app.v3"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("stored objects = %v, want %v", names, want)
+			}
+		})
+	}
+}
+
+func TestRollback(t *testing.T) {
+	tests := []struct {
+		name      string
+		revisions int
+		revision  int
+		want      string
+		wantErr   bool
+	}{
+		{name: "previous revision", revisions: 3, revision: 0, want: "v2"},
+		{name: "given revision", revisions: 3, revision: 1, want: "v1"},
+		{name: "no previous revision", revisions: 1, revision: 0, wantErr: true},
+		{name: "revision not found", revisions: 3, revision: 5, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset()
+			kubeClient.Resources = []*metav1.APIResourceList{{
+				GroupVersion: "v1",
+				APIResources: []metav1.APIResource{{Name: "configmaps", Namespaced: true, Kind: "ConfigMap"}},
+			}}
+			gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+			dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(pkgruntime.NewScheme(),
+				map[schema.GroupVersionResource]string{gvr: "ConfigMapList"})
+
+			cfg := &Config{
+				Namespace:      "default",
+				MaxConcurrency: 1,
+				RequestTimeout: time.Second,
+				History:        History{Name: "app", Namespace: "default", Max: 10},
+			}
+			store := newReleaseStore(kubeClient, &cfg.History, time.Second)
+			for i := 1; i <= tt.revisions; i++ {
+				release := &Release{
+					Namespace: "default",
+					Manifests: [][]map[string]interface{}{{newReleaseManifest("ConfigMap", "app", "v"+strconv.Itoa(i))}},
+				}
+				if err := store.Create(context.Background(), release); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := rollback(context.Background(), cfg, kubeClient, dynamicClient, nil, tt.revision)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rollback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			releases, listErr := store.List(context.Background())
+			if listErr != nil {
+				t.Fatal(listErr)
+			}
+			if tt.wantErr {
+				if len(releases) != tt.revisions {
+					t.Errorf("revisions = %d, want %d, no new revision after the failure", len(releases), tt.revisions)
+				}
+				return
+			}
+
+			cm, err := dynamicClient.Resource(gvr).Namespace("default").Get(context.Background(), "app", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("get the rolled back object failed: %v", err)
+			}
+			if got := cm.Object["data"].(map[string]interface{})["value"]; got != tt.want {
+				t.Errorf("rolled back value = %v, want %s", got, tt.want)
+			}
+			last := releases[len(releases)-1]
+			if last.Revision != tt.revisions+1 {
+				t.Errorf("last revision = %d, want %d for the rollback", last.Revision, tt.revisions+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/constants"
+)
+
+const (
+	// ApplyPolicyCreateOnly never updates the object if it exists.
+	ApplyPolicyCreateOnly = "create-only"
+	// ApplyPolicyReplace deletes and recreates the object if it exists.
+	ApplyPolicyReplace = "replace"
+)
+
+// applyPolicy returns the apply policy of obj, it is empty for updating the object.
+func applyPolicy(obj *unstructured.Unstructured) (string, error) {
+	policy := obj.GetAnnotations()[constants.AnnotationApplyPolicy]
+	switch policy {
+	case "", ApplyPolicyCreateOnly, ApplyPolicyReplace:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unsupported annotation %s (%s) of %s %s, please use `%s` or `%s`",
+		constants.AnnotationApplyPolicy, policy, obj.GetKind(), obj.GetName(), ApplyPolicyCreateOnly, ApplyPolicyReplace)
+}
+
+// shouldForceReplace reports whether obj is replaced when the update is rejected for immutable fields,
+// the annotation of obj takes precedence over the force_replace setting.
+func shouldForceReplace(cfg *Config, obj *unstructured.Unstructured) (bool, error) {
+	value, ok := obj.GetAnnotations()[constants.AnnotationForceReplace]
+	if !ok {
+		return cfg.ForceReplace, nil
+	}
+	force, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid annotation %s (%s) of %s %s",
+			constants.AnnotationForceReplace, value, obj.GetKind(), obj.GetName())
+	}
+	return force, nil
+}
+
+// immutableFields are the field paths of the built-in kinds which cannot be changed by updates.
+var immutableFields = map[string][]string{
+	"Deployment":            {"spec.selector"},
+	"ReplicaSet":            {"spec.selector"},
+	"DaemonSet":             {"spec.selector"},
+	"StatefulSet":           {"spec.selector", "spec"},
+	"Job":                   {"spec.selector", "spec.template", "spec.completions"},
+	"Service":               {"spec.clusterIP", "spec.clusterIPs"},
+	"ConfigMap":             {"data", "binaryData"},
+	"Secret":                {"data", "type"},
+	"PersistentVolume":      {"spec.persistentvolumesource"},
+	"PersistentVolumeClaim": {"spec"},
+	"RoleBinding":           {"roleRef"},
+	"ClusterRoleBinding":    {"roleRef"},
+}
+
+// immutableFieldMessages are the messages of the API server rejecting changes of immutable fields.
+var immutableFieldMessages = []string{
+	"field is immutable",
+	"may not change",
+	"is immutable after creation",
+	"updates to statefulset spec for fields other than",
+	"cannot change roleRef",
+}
+
+var fieldIndexExp = regexp.MustCompile(`\[[^]]*\]`)
+
+// isImmutableFieldError reports whether the update is rejected for changing immutable fields,
+// only the known immutable fields of the built-in kinds are matched,
+// other validation errors would fail again when the object is recreated.
+func isImmutableFieldError(err error) bool {
+	if !apierrors.IsInvalid(err) {
+		return false
+	}
+	var status apierrors.APIStatus
+	if !errors.As(err, &status) || status.Status().Details == nil {
+		return false
+	}
+	details := status.Status().Details
+	fields := immutableFields[details.Kind]
+	if len(fields) == 0 || len(details.Causes) == 0 {
+		return false
+	}
+	for _, cause := range details.Causes {
+		if !containsString(fields, fieldIndexExp.ReplaceAllString(cause.Field, "")) ||
+			!containsImmutableMessage(cause.Message) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsImmutableMessage(message string) bool {
+	for _, v := range immutableFieldMessages {
+		if strings.Contains(message, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceResource deletes the live object and creates obj,
+// the dependents of StatefulSets are orphaned to keep the pods and volumes running.
+// Waiting for the deletion is bounded by waitTimeout, each request is bounded by requestTimeout,
+// once the live object is deleted, obj is created even if ctx is done.
+func replaceResource(
+	ctx context.Context,
+	resourceInter dynamic.ResourceInterface,
+	obj *unstructured.Unstructured,
+	waitTimeout time.Duration,
+	requestTimeout time.Duration,
+	reason string,
+) error {
+	propagation := metav1.DeletePropagationBackground
+	if obj.GetKind() == "StatefulSet" {
+		propagation = metav1.DeletePropagationOrphan
+	}
+	// the live object is deleted only if the new object passes the validation of the API server,
+	// AlreadyExists means the dry run passed the validation and only conflicts with the live object.
+	obj.SetResourceVersion("")
+	err := callWithTimeout(ctx, requestTimeout, func(ctx context.Context) error {
+		_, err := resourceInter.Create(ctx, obj, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+		return err
+	})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("dry run of creating %s %s failed, the live object is kept: %w", obj.GetKind(), obj.GetName(), err)
+	}
+
+	logrus.WithField("kind", obj.GetKind()).
+		WithField("namespace", obj.GetNamespace()).
+		WithField("name", obj.GetName()).
+		WithField("propagation", propagation).
+		Warnf("Replace Resource, the object is deleted and recreated %s", reason)
+
+	if err := deleteAndWait(ctx, resourceInter, obj.GetName(), propagation, waitTimeout, requestTimeout); err != nil {
+		return err
+	}
+	err = callWithTimeout(context.Background(), requestTimeout, func(ctx context.Context) error {
+		_, err := resourceInter.Create(ctx, obj, metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("create %s %s failed: %v", obj.GetKind(), obj.GetName(), err)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	pkgruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/constants"
+)
+
+func TestIsImmutableFieldError(t *testing.T) {
+	newInvalid := func(kind string, errs ...*field.Error) error {
+		return apierrors.NewInvalid(schema.GroupKind{Kind: kind}, "app", errs)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "deployment selector",
+			err:  newInvalid("Deployment", field.Invalid(field.NewPath("spec", "selector"), nil, "field is immutable")),
+			want: true,
+		},
+		{
+			name: "job template",
+			err:  newInvalid("Job", field.Invalid(field.NewPath("spec", "template"), nil, "field is immutable")),
+			want: true,
+		},
+		{
+			name: "service cluster ip",
+			err:  newInvalid("Service", field.Invalid(field.NewPath("spec", "clusterIPs").Index(0), "10.0.0.2", "may not change once set")),
+			want: true,
+		},
+		{
+			name: "statefulset spec",
+			err: newInvalid("StatefulSet", field.Forbidden(field.NewPath("spec"),
+				"updates to statefulset spec for fields other than 'replicas', 'template', 'updateStrategy' and 'minReadySeconds' are forbidden")),
+			want: true,
+		},
+		{
+			name: "forbidden without immutability",
+			err: newInvalid("Pod", field.Forbidden(field.NewPath("spec", "containers").Index(0).Child("securityContext", "privileged"),
+				"disallowed by cluster policy")),
+		},
+		{
+			name: "forbidden on known kind",
+			err: newInvalid("Deployment", field.Forbidden(field.NewPath("spec", "template", "spec", "hostNetwork"),
+				"disallowed by cluster policy")),
+		},
+		{
+			name: "immutable message on unknown path",
+			err:  newInvalid("Deployment", field.Invalid(field.NewPath("spec", "replicas"), nil, "field is immutable")),
+		},
+		{
+			name: "immutable field with other invalid fields",
+			err: newInvalid("Deployment",
+				field.Invalid(field.NewPath("spec", "selector"), nil, "field is immutable"),
+				field.Required(field.NewPath("spec", "template", "spec", "containers"), ""),
+			),
+		},
+		{
+			name: "unknown kind",
+			err:  newInvalid("Foo", field.Invalid(field.NewPath("spec", "selector"), nil, "field is immutable")),
+		},
+		{
+			name: "not invalid",
+			err:  apierrors.NewConflict(schema.GroupResource{Resource: "deployments"}, "app", errors.New("field is immutable")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isImmutableFieldError(tt.err); got != tt.want {
+				t.Errorf("isImmutableFieldError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplaceResource_DryRunFailed(t *testing.T) {
+	gvr := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	live := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	live.SetAPIVersion("apps/v1")
+	live.SetKind("Deployment")
+	live.SetNamespace("default")
+	live.SetName("app")
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(pkgruntime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "DeploymentList"}, live)
+	dynamicClient.PrependReactor("create", "deployments", func(action clienttesting.Action) (bool, pkgruntime.Object, error) {
+		return true, nil, apierrors.NewInvalid(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "app", field.ErrorList{
+			field.Forbidden(field.NewPath("spec", "template", "spec", "hostNetwork"), "disallowed by cluster policy"),
+		})
+	})
+
+	obj := live.DeepCopy()
+	resourceInter := dynamicClient.Resource(gvr).Namespace("default")
+	err := replaceResource(context.Background(), resourceInter, obj, time.Second, time.Second, "for testing")
+	if err == nil {
+		t.Fatal("replaceResource() error = nil, want error")
+	}
+	for _, action := range dynamicClient.Actions() {
+		if action.GetVerb() == "delete" {
+			t.Fatal("the live object is deleted after the dry run failed")
+		}
+	}
+}
+
+func TestReplaceResource(t *testing.T) {
+	gvr := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	live := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	live.SetAPIVersion("apps/v1")
+	live.SetKind("Deployment")
+	live.SetNamespace("default")
+	live.SetName("app")
+	live.SetResourceVersion("1")
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(pkgruntime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "DeploymentList"}, live)
+
+	obj := live.DeepCopy()
+	obj.SetLabels(map[string]string{"app": "new"})
+	resourceInter := dynamicClient.Resource(gvr).Namespace("default")
+	if err := replaceResource(context.Background(), resourceInter, obj, time.Second, time.Second, "for testing"); err != nil {
+		t.Fatalf("replaceResource() error = %v", err)
+	}
+
+	var verbs []string
+	for _, action := range dynamicClient.Actions() {
+		verbs = append(verbs, action.GetVerb())
+	}
+	if want := []string{"create", "delete", "get", "create"}; !reflect.DeepEqual(verbs, want) {
+		t.Errorf("actions = %v, want %v", verbs, want)
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    string
+		wantErr bool
+	}{
+		{policy: "", want: ""},
+		{policy: ApplyPolicyCreateOnly, want: ApplyPolicyCreateOnly},
+		{policy: ApplyPolicyReplace, want: ApplyPolicyReplace},
+		{policy: "Replace", wantErr: true},
+		{policy: "create_only", wantErr: true},
+		{policy: "update", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			obj.SetKind("ConfigMap")
+			obj.SetName("app")
+			if tt.policy != "" {
+				obj.SetAnnotations(map[string]string{constants.AnnotationApplyPolicy: tt.policy})
+			}
+			got, err := applyPolicy(obj)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("applyPolicy() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyObject_CreateOnly(t *testing.T) {
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	live := &unstructured.Unstructured{Object: map[string]interface{}{
+		"data": map[string]interface{}{"key": "live"},
+	}}
+	live.SetAPIVersion("v1")
+	live.SetKind("ConfigMap")
+	live.SetNamespace("default")
+	live.SetName("app")
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(pkgruntime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "ConfigMapList"}, live)
+
+	obj := live.DeepCopy()
+	obj.Object["data"] = map[string]interface{}{"key": "new"}
+	obj.SetAnnotations(map[string]string{constants.AnnotationApplyPolicy: ApplyPolicyCreateOnly})
+	resourceInter := dynamicClient.Resource(gvr).Namespace("default")
+	action, err := applyObject(context.Background(), context.Background(), dynamicClient, nil, resourceInter, obj, &Config{})
+	if err != nil {
+		t.Fatalf("applyObject() error = %v", err)
+	}
+	if action != ActionUnchanged {
+		t.Errorf("applyObject() = %s, want %s", action, ActionUnchanged)
+	}
+	for _, action := range dynamicClient.Actions() {
+		if action.GetVerb() != "get" {
+			t.Errorf("unexpected %s of the existing create-only object", action.GetVerb())
+		}
+	}
+}
+
+func TestApplyResources_GenerateName(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}
+	gvr := schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(pkgruntime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "JobList"})
+	dynamicClient.PrependReactor("create", "jobs", func(action clienttesting.Action) (bool, pkgruntime.Object, error) {
+		// the fake client does not generate names like the API server
+		obj := action.(clienttesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		obj.SetName(obj.GetGenerateName() + "x7k2p")
+		return false, nil, nil
+	})
+
+	obj := unstructured.Unstructured{Object: map[string]interface{}{}}
+	obj.SetGroupVersionKind(gvk)
+	obj.SetGenerateName("migrate-")
+
+	mapping := meta.NewDefaultRESTMapper(nil)
+	mapping.Add(gvk, meta.RESTScopeNamespace)
+	cfg := &Config{MaxConcurrency: 1, RequestTimeout: time.Second}
+	report := NewReport(nil)
+	if err := applyResources(context.Background(), dynamicClient, mapping,
+		[][]unstructured.Unstructured{{obj}}, cfg, "default", report); err != nil {
+		t.Fatalf("applyResources() error = %v", err)
+	}
+
+	items := report.List()
+	if len(items) != 1 {
+		t.Fatalf("report items = %v, want 1 item", items)
+	}
+	if items[0].Name != "migrate-x7k2p" || items[0].Action != ActionCreated {
+		t.Errorf("report item = %s %s, want migrate-x7k2p %s", items[0].Name, items[0].Action, ActionCreated)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/redact"
+)
+
+type Action string
+
+const (
+	ActionCreated   Action = "created"
+	ActionUpdated   Action = "updated"
+	ActionReplaced  Action = "replaced"
+	ActionUnchanged Action = "unchanged"
+	ActionFailed    Action = "failed"
+)
+
+// Report is the machine-readable result of a run.
+type Report struct {
+	mu sync.Mutex
+	// redactor masks the secret values in the error messages when the report is written.
+	redactor *redact.Redactor
+
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at"`
+	Success    bool         `json:"success"`
+	Error      string       `json:"error,omitempty"`
+	Items      []ReportItem `json:"items"`
+	// Images are the container images replaced by the image overrides.
+	Images []ImageReplacement `json:"images,omitempty"`
+}
+
+// ReportItem is the result of applying an object.
+type ReportItem struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	Action     Action `json:"action"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+	// Addresses are the hostnames or IPs assigned to LoadBalancer Services and Ingresses.
+	Addresses []string `json:"addresses,omitempty"`
+	// Ready is the result of readiness check, it is nil if the object is not checked.
+	Ready *bool `json:"ready,omitempty"`
+	// Hook is the phase if the object is a hook, the hooks are not waited after applying.
+	Hook HookPhase `json:"hook,omitempty"`
+}
+
+func NewReport(redactor *redact.Redactor) *Report {
+	return &Report{
+		redactor:  redactor,
+		StartedAt: time.Now(),
+		Items:     make([]ReportItem, 0),
+	}
+}
+
+// Add records the result of applying obj, which started at start.
+func (r *Report) Add(obj *unstructured.Unstructured, action Action, start time.Time, err error) {
+	r.add(newReportItem(obj, action, start, err))
+}
+
+// AddHook records the result of running the hook obj of the phase, which started at start.
+func (r *Report) AddHook(obj *unstructured.Unstructured, phase HookPhase, start time.Time, err error) {
+	item := newReportItem(obj, ActionCreated, start, err)
+	item.Hook = phase
+	r.add(item)
+}
+
+func (r *Report) add(item ReportItem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Items = append(r.Items, item)
+}
+
+func newReportItem(obj *unstructured.Unstructured, action Action, start time.Time, err error) ReportItem {
+	item := ReportItem{
+		APIVersion: obj.GetAPIVersion(),
+		Kind:       obj.GetKind(),
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+		Action:     action,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		item.Action = ActionFailed
+		item.Error = err.Error()
+	}
+	return item
+}
+
+// List returns a copy of the report items.
+func (r *Report) List() []ReportItem {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ReportItem{}, r.Items...)
+}
+
+// Update calls fn with the report item at index i.
+func (r *Report) Update(i int, fn func(item *ReportItem)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i >= 0 && i < len(r.Items) {
+		fn(&r.Items[i])
+	}
+}
+
+// Finish marks the end of the run.
+func (r *Report) Finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.FinishedAt = time.Now()
+	r.Success = err == nil
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// WriteFile writes the report as JSON to the file path.
+func (r *Report) WriteFile(filePath string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if dir := filepath.Dir(filePath); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(r.redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, b, 0644)
+}
+
+// redacted returns a copy of the report whose error messages are redacted.
+func (r *Report) redacted() *Report {
+	out := &Report{
+		StartedAt:  r.StartedAt,
+		FinishedAt: r.FinishedAt,
+		Success:    r.Success,
+		Error:      r.redactor.Redact(r.Error),
+		Items:      make([]ReportItem, 0, len(r.Items)),
+		Images:     r.Images,
+	}
+	for _, item := range r.Items {
+		item.Error = r.redactor.Redact(item.Error)
+		out.Items = append(out.Items, item)
+	}
+	return out
+}
+
+// WriteSummary writes the report items as a table, the error messages are redacted.
+func (r *Report) WriteSummary(out io.Writer) error {
+	r.mu.Lock()
+	items := r.redacted().Items
+	r.mu.Unlock()
+	if len(items) == 0 {
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAMESPACE\tNAME\tACTION\tDURATION\tERROR")
+	for _, item := range items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			item.Kind, item.Namespace, item.Name, item.Action,
+			time.Duration(item.DurationMs)*time.Millisecond, item.Error)
+	}
+	return w.Flush()
+}
+
+// LogSummary logs the report items as structured entries instead of a table,
+// it is used when the logs are JSON.
+func (r *Report) LogSummary() {
+	for _, item := range r.List() {
+		entry := logrus.WithField("apiVersion", item.APIVersion).
+			WithField("kind", item.Kind).
+			WithField("namespace", item.Namespace).
+			WithField("name", item.Name).
+			WithField("action", item.Action).
+			WithField("duration_ms", item.DurationMs)
+		if item.Error != "" {
+			entry = entry.WithField("error", item.Error)
+		}
+		entry.Info("Summary")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/redact"
+)
+
+func TestReport_WriteFile(t *testing.T) {
+	redactor := redact.New()
+	redactor.AddValues("s3cr3t-token")
+
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Secret")
+	obj.SetNamespace("default")
+	obj.SetName("app")
+
+	report := NewReport(redactor)
+	report.Add(obj, ActionCreated, time.Now(), errors.New("invalid value s3cr3t-token"))
+	report.Finish(errors.New("apply failed: invalid value s3cr3t-token"))
+
+	filePath := filepath.Join(t.TempDir(), "out", "report.json")
+	if err := report.WriteFile(filePath); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	b, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Report
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Success {
+		t.Error("Success = true, want false")
+	}
+	if want := "apply failed: invalid value " + redact.Mask; got.Error != want {
+		t.Errorf("Error = %q, want %q", got.Error, want)
+	}
+	if len(got.Items) != 1 {
+		t.Fatalf("len(Items) = %d, want 1", len(got.Items))
+	}
+	if got.Items[0].Action != ActionFailed {
+		t.Errorf("Items[0].Action = %s, want %s", got.Items[0].Action, ActionFailed)
+	}
+	if want := "invalid value " + redact.Mask; got.Items[0].Error != want {
+		t.Errorf("Items[0].Error = %q, want %q", got.Items[0].Error, want)
+	}
+	// the report in memory is not changed
+	if report.Items[0].Error != "invalid value s3cr3t-token" {
+		t.Errorf("report.Items[0].Error = %q, the original error is changed", report.Items[0].Error)
+	}
+}
+
+func TestReport_Summary(t *testing.T) {
+	redactor := redact.New()
+	redactor.AddValues("s3cr3t-token")
+
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Secret")
+	obj.SetNamespace("default")
+	obj.SetName("app")
+
+	report := NewReport(redactor)
+	report.Add(obj, ActionFailed, time.Now(), errors.New("invalid value s3cr3t-token"))
+
+	var table bytes.Buffer
+	if err := report.WriteSummary(&table); err != nil {
+		t.Fatalf("WriteSummary() error = %v", err)
+	}
+	if out := table.String(); strings.Contains(out, "s3cr3t-token") || !strings.Contains(out, redact.Mask) {
+		t.Errorf("WriteSummary() = %s, the error is not redacted", out)
+	}
+
+	var logs bytes.Buffer
+	logger := logrus.StandardLogger()
+	out, formatter := logger.Out, logger.Formatter
+	defer func() {
+		logger.SetOutput(out)
+		logger.SetFormatter(formatter)
+	}()
+	logger.SetOutput(&logs)
+	logger.SetFormatter(redactor.Formatter(&logrus.JSONFormatter{}))
+
+	report.LogSummary()
+	var entry map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("LogSummary() = %s, not a JSON entry: %v", logs.String(), err)
+	}
+	if entry["kind"] != "Secret" || entry["name"] != "app" {
+		t.Errorf("LogSummary() = %v, want kind Secret and name app", entry)
+	}
+	if want := "invalid value " + redact.Mask; entry["error"] != want {
+		t.Errorf("LogSummary() error = %v, want %q", entry["error"], want)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	defaultRetryAttempts   = 5
+	defaultRetryBackoff    = time.Second
+	defaultRetryMaxBackoff = 30 * time.Second
+)
+
+// Retry is the exponential backoff of retrying the transient API errors.
+type Retry struct {
+	// Attempts is the max number of attempts, defaults to 5, set it to 1 to disable retries.
+	Attempts int `json:"attempts"`
+	// Backoff is the initial delay, doubled after each retry, defaults to 1s.
+	Backoff time.Duration `json:"backoff"`
+	// MaxBackoff is the max delay between retries, defaults to 30s.
+	MaxBackoff time.Duration `json:"max_backoff"`
+}
+
+func (r *Retry) complete() {
+	if r.Attempts <= 0 {
+		r.Attempts = defaultRetryAttempts
+	}
+	if r.Backoff <= 0 {
+		r.Backoff = defaultRetryBackoff
+	}
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if r.MaxBackoff < r.Backoff {
+		r.MaxBackoff = r.Backoff
+	}
+}
+
+// isRetryableError reports whether the error is transient,
+// e.g. conflicts, throttling, server errors and timeouts.
+func isRetryableError(err error) bool {
+	switch {
+	case apierrors.IsConflict(err),
+		apierrors.IsTooManyRequests(err),
+		apierrors.IsServerTimeout(err),
+		apierrors.IsTimeout(err),
+		apierrors.IsInternalError(err),
+		apierrors.IsServiceUnavailable(err),
+		apierrors.IsUnexpectedServerError(err):
+		return true
+	case utilnet.IsConnectionReset(err),
+		utilnet.IsConnectionRefused(err),
+		utilnet.IsProbableEOF(err):
+		return true
+	}
+
+	var status apierrors.APIStatus
+	if errors.As(err, &status) && status.Status().Code >= 500 {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isRetryableCreateError reports whether the request is rejected before it is processed by the server,
+// it is used for the requests which are not idempotent, e.g. creating objects with generateName,
+// since retrying after a timeout or a server error may create the object twice.
+func isRetryableCreateError(err error) bool {
+	return apierrors.IsTooManyRequests(err) || utilnet.IsConnectionRefused(err)
+}
+
+// withRetry calls fn until it succeeds, returns an error which is not retryable, or the attempts are exhausted.
+// fn should fetch the live object again in each call, so that the conflicts are resolved,
+// each call is bounded by timeout if it is positive.
+func withRetry(
+	ctx context.Context,
+	retry *Retry,
+	timeout time.Duration,
+	logger *logrus.Entry,
+	retryable func(err error) bool,
+	fn func(ctx context.Context) error,
+) error {
+	backoff := wait.Backoff{
+		Duration: retry.Backoff,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    retry.Attempts,
+		Cap:      retry.MaxBackoff,
+	}
+	for attempt := 1; ; attempt++ {
+		err := callWithTimeout(ctx, timeout, fn)
+		if err == nil {
+			if attempt > 1 {
+				logger.Infof("Succeeded after %d retries", attempt-1)
+			}
+			return nil
+		}
+		if attempt >= retry.Attempts || ctx.Err() != nil || !retryable(err) {
+			if attempt > 1 {
+				logger.Warnf("Failed after %d retries", attempt-1)
+			}
+			return err
+		}
+
+		delay := backoff.Step()
+		logger.WithField("attempt", attempt).
+			Warnf("Retry in %s for the transient error: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// callWithTimeout calls fn with ctx bounded by timeout if it is positive.
+func callWithTimeout(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+// getWithTimeout gets the object by name, the request is bounded by timeout if it is positive.
+func getWithTimeout(
+	ctx context.Context,
+	resourceInter dynamic.ResourceInterface,
+	name string,
+	timeout time.Duration,
+) (*unstructured.Unstructured, error) {
+	var obj *unstructured.Unstructured
+	err := callWithTimeout(ctx, timeout, func(ctx context.Context) error {
+		var err error
+		obj, err = resourceInter.Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	return obj, err
+}
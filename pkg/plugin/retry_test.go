@@ -0,0 +1,144 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetryableError(t *testing.T) {
+	gr := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}
+
+	tests := []struct {
+		name       string
+		err        error
+		want       bool
+		wantCreate bool
+	}{
+		{name: "conflict", err: apierrors.NewConflict(gr, "app", errors.New("modified")), want: true},
+		{name: "too many requests", err: apierrors.NewTooManyRequests("throttled", 1), want: true, wantCreate: true},
+		{name: "server timeout", err: apierrors.NewServerTimeout(gr, "create", 1), want: true},
+		{name: "timeout", err: apierrors.NewTimeoutError("timeout", 1), want: true},
+		{name: "internal error", err: apierrors.NewInternalError(errors.New("etcd")), want: true},
+		{name: "service unavailable", err: apierrors.NewServiceUnavailable("unavailable"), want: true},
+		{name: "bad gateway", err: apierrors.NewGenericServerResponse(502, "create", gr, "app", "", 0, false), want: true},
+		{name: "connection refused", err: refused, want: true, wantCreate: true},
+		{name: "wrapped connection refused", err: fmt.Errorf("create failed: %w", refused), want: true, wantCreate: true},
+		{name: "net timeout", err: timeoutError{}, want: true},
+		{name: "not found", err: apierrors.NewNotFound(gr, "app")},
+		{name: "already exists", err: apierrors.NewAlreadyExists(gr, "app")},
+		{name: "forbidden", err: apierrors.NewForbidden(gr, "app", errors.New("rbac"))},
+		{name: "bad request", err: apierrors.NewBadRequest("invalid")},
+		{name: "plain error", err: errors.New("failed")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableError(tt.err); got != tt.want {
+				t.Errorf("isRetryableError() = %v, want %v", got, tt.want)
+			}
+			if got := isRetryableCreateError(tt.err); got != tt.wantCreate {
+				t.Errorf("isRetryableCreateError() = %v, want %v", got, tt.wantCreate)
+			}
+		})
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	retry := &Retry{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	conflict := apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "app", errors.New("modified"))
+
+	tests := []struct {
+		name      string
+		retryable func(err error) bool
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "succeeded", retryable: isRetryableError, errs: []error{nil}, wantCalls: 1},
+		{name: "succeeded after retries", retryable: isRetryableError, errs: []error{conflict, conflict, nil}, wantCalls: 3},
+		{name: "attempts exhausted", retryable: isRetryableError, errs: []error{conflict, conflict, conflict}, wantCalls: 3, wantErr: true},
+		{name: "not retryable", retryable: isRetryableError, errs: []error{errors.New("failed")}, wantCalls: 1, wantErr: true},
+		{name: "create not retried", retryable: isRetryableCreateError, errs: []error{apierrors.NewInternalError(errors.New("etcd"))}, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := withRetry(context.Background(), retry, time.Second, logger, tt.retryable, func(ctx context.Context) error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("withRetry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCallWithTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeout      time.Duration
+		wantDeadline bool
+	}{
+		{name: "bounded", timeout: time.Minute, wantDeadline: true},
+		{name: "unbounded", timeout: 0, wantDeadline: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hasDeadline bool
+			err := callWithTimeout(context.Background(), tt.timeout, func(ctx context.Context) error {
+				_, hasDeadline = ctx.Deadline()
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("callWithTimeout() error = %v", err)
+			}
+			if hasDeadline != tt.wantDeadline {
+				t.Errorf("callWithTimeout() deadline = %v, want %v", hasDeadline, tt.wantDeadline)
+			}
+		})
+	}
+
+	err := callWithTimeout(context.Background(), 10*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("callWithTimeout() of hung call error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
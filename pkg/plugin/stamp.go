@@ -0,0 +1,120 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+)
+
+// DefaultStampKeys are the Drone environment variables stamped onto the applied objects by default.
+var DefaultStampKeys = []string{
+	"DRONE_REPO",
+	"DRONE_COMMIT_SHA",
+	"DRONE_BUILD_NUMBER",
+	"DRONE_BUILD_LINK",
+	"DRONE_COMMIT_AUTHOR",
+}
+
+var invalidLabelValueExp = regexp.MustCompile(`[^-A-Za-z0-9_.]`)
+
+// stampName converts the environment variable name to the key name,
+// e.g. `DRONE_COMMIT_SHA` to `commit-sha`.
+func stampName(key string) string {
+	name := strings.TrimPrefix(strings.ToUpper(key), "DRONE_")
+	return strings.ReplaceAll(strings.ToLower(name), "_", "-")
+}
+
+// labelValue converts the value to a valid label value.
+func labelValue(value string) string {
+	value = invalidLabelValueExp.ReplaceAllString(value, "-")
+	if len(value) > validation.LabelValueMaxLength {
+		value = value[:validation.LabelValueMaxLength]
+	}
+	return strings.Trim(value, "-_.")
+}
+
+// stampObjects adds the Drone build metadata as annotations and labels to the objects,
+// and to the pod templates of workloads if cfg.StampPodTemplate is enabled.
+func stampObjects(cfg *Config, envMap map[string]string, objs []unstructured.Unstructured) {
+	keys := cfg.StampKeys
+	if len(keys) == 0 {
+		keys = DefaultStampKeys
+	}
+	labelKeys := make(map[string]struct{}, len(cfg.StampLabels))
+	for _, v := range cfg.StampLabels {
+		labelKeys[strings.ToUpper(v)] = struct{}{}
+	}
+
+	annotations := make(map[string]string)
+	labels := make(map[string]string)
+	for _, key := range keys {
+		value, ok := envMap[key]
+		if !ok || value == "" {
+			continue
+		}
+		name := cfg.StampPrefix + stampName(key)
+		annotations[name] = value
+		if _, ok := labelKeys[strings.ToUpper(key)]; ok {
+			labels[name] = labelValue(value)
+		}
+	}
+	if len(annotations) == 0 {
+		return
+	}
+
+	for i := range objs {
+		obj := &objs[i]
+		obj.SetAnnotations(mergeStringMap(obj.GetAnnotations(), annotations))
+		if len(labels) > 0 {
+			obj.SetLabels(mergeStringMap(obj.GetLabels(), labels))
+		}
+
+		if !cfg.StampPodTemplate || !stampablePodTemplate(obj.GetKind()) {
+			continue
+		}
+		metadataPath := kube.PodTemplateMetadataPath(obj.GetKind())
+		if metadataPath == nil {
+			continue
+		}
+		podAnnotations, _, _ := unstructured.NestedStringMap(obj.Object, append(metadataPath, "annotations")...)
+		_ = unstructured.SetNestedStringMap(obj.Object, mergeStringMap(podAnnotations, annotations), append(metadataPath, "annotations")...)
+		if len(labels) > 0 {
+			podLabels, _, _ := unstructured.NestedStringMap(obj.Object, append(metadataPath, "labels")...)
+			_ = unstructured.SetNestedStringMap(obj.Object, mergeStringMap(podLabels, labels), append(metadataPath, "labels")...)
+		}
+	}
+}
+
+// stampablePodTemplate reports whether the pod template of the kind can be stamped,
+// the pod templates of Jobs are immutable, and a changed pod template of CronJobs only affects the next Jobs.
+func stampablePodTemplate(kind string) bool {
+	return kind != "Job" && kind != "CronJob"
+}
+
+func mergeStringMap(dst, src map[string]string) map[string]string {
+	if dst == nil {
+		dst = make(map[string]string, len(src))
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
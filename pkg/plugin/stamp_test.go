@@ -0,0 +1,87 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+)
+
+func TestStampObjects(t *testing.T) {
+	envMap := map[string]string{
+		"DRONE_COMMIT_SHA":   "0123456789abcdef",
+		"DRONE_BUILD_NUMBER": "42",
+	}
+	wantAnnotations := map[string]string{
+		"drone-k8s-plugin/commit-sha":   "0123456789abcdef",
+		"drone-k8s-plugin/build-number": "42",
+	}
+
+	tests := []struct {
+		name             string
+		kind             string
+		stampPodTemplate bool
+		wantPodTemplate  bool
+	}{
+		{name: "deployment by default", kind: "Deployment"},
+		{name: "deployment opt-in", kind: "Deployment", stampPodTemplate: true, wantPodTemplate: true},
+		{name: "job opt-in", kind: "Job", stampPodTemplate: true},
+		{name: "cronjob opt-in", kind: "CronJob", stampPodTemplate: true},
+		{name: "service", kind: "Service", stampPodTemplate: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				StampPrefix:      "drone-k8s-plugin/",
+				StampKeys:        []string{"DRONE_COMMIT_SHA", "DRONE_BUILD_NUMBER", "DRONE_REPO"},
+				StampPodTemplate: tt.stampPodTemplate,
+			}
+			obj := unstructured.Unstructured{Object: map[string]interface{}{}}
+			obj.SetKind(tt.kind)
+			obj.SetName("app")
+			objs := []unstructured.Unstructured{obj}
+
+			stampObjects(cfg, envMap, objs)
+			if got := objs[0].GetAnnotations(); !reflect.DeepEqual(got, wantAnnotations) {
+				t.Errorf("annotations = %v, want %v", got, wantAnnotations)
+			}
+
+			var podAnnotations map[string]string
+			if path := kube.PodTemplateMetadataPath(tt.kind); path != nil {
+				podAnnotations, _, _ = unstructured.NestedStringMap(objs[0].Object, append(path, "annotations")...)
+			}
+			if tt.wantPodTemplate != (podAnnotations != nil) {
+				t.Errorf("pod template annotations = %v, want stamped %v", podAnnotations, tt.wantPodTemplate)
+			}
+		})
+	}
+}
+
+func TestStampName(t *testing.T) {
+	tests := map[string]string{
+		"DRONE_COMMIT_SHA": "commit-sha",
+		"drone_repo":       "repo",
+		"CI_BUILD_NUMBER":  "ci-build-number",
+	}
+	for key, want := range tests {
+		if got := stampName(key); got != want {
+			t.Errorf("stampName(%s) = %s, want %s", key, got, want)
+		}
+	}
+}
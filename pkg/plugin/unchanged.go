@@ -0,0 +1,70 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// serverPopulatedFields are the fields which are changed by the server on every write.
+var serverPopulatedFields = [][]string{
+	{"metadata", "resourceVersion"},
+	{"metadata", "generation"},
+	{"metadata", "managedFields"},
+	{"status"},
+}
+
+// isUnchanged reports whether updating the live object to obj changes nothing.
+// The update is sent as a dry-run so that obj is defaulted by the server in the same way,
+// any error of the dry-run is regarded as changed and left to the real update.
+func isUnchanged(
+	ctx context.Context,
+	resourceInter dynamic.ResourceInterface,
+	live, obj *unstructured.Unstructured,
+) bool {
+	result, err := resourceInter.Update(ctx, obj, metav1.UpdateOptions{DryRun: []string{metav1.DryRunAll}})
+	if err != nil {
+		logrus.WithField("kind", obj.GetKind()).
+			WithField("name", obj.GetName()).
+			Debugf("Dry-run update failed: %v", err)
+		return false
+	}
+	return equality.Semantic.DeepEqual(normalizeObject(live), normalizeObject(result))
+}
+
+// normalizeObject returns a copy of obj without the server-populated fields.
+func normalizeObject(obj *unstructured.Unstructured) map[string]interface{} {
+	current := obj.DeepCopy()
+	for _, fields := range serverPopulatedFields {
+		unstructured.RemoveNestedField(current.Object, fields...)
+	}
+	return current.Object
+}
+
+// isConfigMapUnchanged reports whether updating the live ConfigMap to cm changes nothing.
+func isConfigMapUnchanged(live, cm *v1.ConfigMap) bool {
+	return live.Immutable == nil && cm.Immutable == nil &&
+		equality.Semantic.DeepEqual(live.Data, cm.Data) &&
+		equality.Semantic.DeepEqual(live.BinaryData, cm.BinaryData) &&
+		equality.Semantic.DeepEqual(live.Labels, cm.Labels) &&
+		equality.Semantic.DeepEqual(live.Annotations, cm.Annotations)
+}
@@ -0,0 +1,177 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	pkgruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestNormalizeObject(t *testing.T) {
+	obj := mustObject(t, `
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+  resourceVersion: "3"
+  generation: 2
+  managedFields:
+  - manager: kubectl
+  labels:
+    app: app
+spec:
+  type: ClusterIP
+status:
+  loadBalancer: {}
+`)
+	want := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata": map[string]interface{}{
+			"name":   "app",
+			"labels": map[string]interface{}{"app": "app"},
+		},
+		"spec": map[string]interface{}{"type": "ClusterIP"},
+	}
+	if got := normalizeObject(obj); !reflect.DeepEqual(got, want) {
+		t.Errorf("normalizeObject() = %v, want %v", got, want)
+	}
+	if obj.GetResourceVersion() != "3" || obj.Object["status"] == nil {
+		t.Error("normalizeObject() changes the object")
+	}
+}
+
+func TestIsConfigMapUnchanged(t *testing.T) {
+	immutable := true
+	newConfigMap := func(fn func(cm *v1.ConfigMap)) *v1.ConfigMap {
+		cm := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "app",
+				Labels:      map[string]string{"app": "app"},
+				Annotations: map[string]string{"owner": "ops"},
+			},
+			Data:       map[string]string{"key": "value"},
+			BinaryData: map[string][]byte{"bin": []byte("value")},
+		}
+		if fn != nil {
+			fn(cm)
+		}
+		return cm
+	}
+
+	tests := []struct {
+		name string
+		cm   *v1.ConfigMap
+		live *v1.ConfigMap
+		want bool
+	}{
+		{
+			name: "unchanged",
+			cm:   newConfigMap(nil),
+			live: newConfigMap(func(cm *v1.ConfigMap) { cm.ResourceVersion = "3" }),
+			want: true,
+		},
+		{
+			name: "data changed",
+			cm:   newConfigMap(func(cm *v1.ConfigMap) { cm.Data["key"] = "new" }),
+			live: newConfigMap(nil),
+		},
+		{
+			name: "binary data changed",
+			cm:   newConfigMap(func(cm *v1.ConfigMap) { cm.BinaryData = nil }),
+			live: newConfigMap(nil),
+		},
+		{
+			name: "labels changed",
+			cm:   newConfigMap(func(cm *v1.ConfigMap) { cm.Labels["app"] = "new" }),
+			live: newConfigMap(nil),
+		},
+		{
+			name: "annotations changed",
+			cm:   newConfigMap(func(cm *v1.ConfigMap) { cm.Annotations = nil }),
+			live: newConfigMap(nil),
+		},
+		{
+			name: "immutable",
+			cm:   newConfigMap(func(cm *v1.ConfigMap) { cm.Immutable = &immutable }),
+			live: newConfigMap(func(cm *v1.ConfigMap) { cm.Immutable = &immutable }),
+		},
+		{
+			name: "live immutable",
+			cm:   newConfigMap(nil),
+			live: newConfigMap(func(cm *v1.ConfigMap) { cm.Immutable = &immutable }),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isConfigMapUnchanged(tt.live, tt.cm); got != tt.want {
+				t.Errorf("isConfigMapUnchanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsUnchanged(t *testing.T) {
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "services"}
+	newService := func(resourceVersion, typ string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{"type": typ},
+		}}
+		obj.SetAPIVersion("v1")
+		obj.SetKind("Service")
+		obj.SetNamespace("default")
+		obj.SetName("app")
+		obj.SetResourceVersion(resourceVersion)
+		return obj
+	}
+
+	tests := []struct {
+		name       string
+		obj        *unstructured.Unstructured
+		dryRunFail bool
+		want       bool
+	}{
+		{name: "unchanged", obj: newService("", "ClusterIP"), want: true},
+		{name: "changed", obj: newService("", "NodePort")},
+		{name: "dry run failed", obj: newService("", "ClusterIP"), dryRunFail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := newService("1", "ClusterIP")
+			dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(pkgruntime.NewScheme(),
+				map[schema.GroupVersionResource]string{gvr: "ServiceList"}, live)
+			if tt.dryRunFail {
+				dynamicClient.PrependReactor("update", "services", func(action clienttesting.Action) (bool, pkgruntime.Object, error) {
+					return true, nil, apierrors.NewForbidden(gvr.GroupResource(), "app", nil)
+				})
+			}
+
+			resourceInter := dynamicClient.Resource(gvr).Namespace("default")
+			if got := isUnchanged(context.Background(), resourceInter, live, tt.obj); got != tt.want {
+				t.Errorf("isUnchanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/zc2638/drone-k8s-plugin/pkg/kube"
+)
+
+const (
+	defaultWaitTimeout = 5 * time.Minute
+	waitInterval       = 2 * time.Second
+)
+
+// waitLoadBalancers waits until the addresses are assigned to the applied LoadBalancer Services and Ingresses,
+// the objects are waited in parallel under the same deadline, and each request is bounded by requestTimeout.
+func waitLoadBalancers(
+	ctx context.Context,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	report *Report,
+	timeout time.Duration,
+	requestTimeout time.Duration,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	eg := new(errgroup.Group)
+	for i, item := range report.List() {
+		if item.Action == ActionFailed || item.Hook != "" || (item.Kind != "Service" && item.Kind != "Ingress") {
+			continue
+		}
+
+		i, item := i, item
+		eg.Go(func() error {
+			addresses, err := waitLoadBalancer(ctx, dynamicClient, mapping, item, requestTimeout)
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("wait for the address of %s %s/%s timeout after %s", item.Kind, item.Namespace, item.Name, timeout)
+			}
+			if err != nil {
+				return fmt.Errorf("wait for the address of %s %s/%s failed: %v", item.Kind, item.Namespace, item.Name, err)
+			}
+			if len(addresses) == 0 {
+				return nil
+			}
+
+			logrus.WithField("kind", item.Kind).
+				WithField("namespace", item.Namespace).
+				WithField("name", item.Name).
+				WithField("addresses", addresses).
+				Info("LoadBalancer address assigned")
+			report.Update(i, func(item *ReportItem) {
+				item.Addresses = addresses
+			})
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// waitLoadBalancer waits until ctx is done or the addresses are assigned to the object,
+// no addresses are returned if the object is a Service of other types.
+func waitLoadBalancer(
+	ctx context.Context,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	item ReportItem,
+	requestTimeout time.Duration,
+) ([]string, error) {
+	gv, err := schema.ParseGroupVersion(item.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+	resourceInter, _, err := newResourceInterface(dynamicClient, mapping, gv.WithKind(item.Kind), item.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	err = wait.PollImmediateUntilWithContext(ctx, waitInterval, func(ctx context.Context) (bool, error) {
+		obj, err := getWithTimeout(ctx, resourceInter, item.Name, requestTimeout)
+		if err != nil {
+			return false, err
+		}
+		if obj.GetKind() == "Service" {
+			svcType, _, _ := unstructured.NestedString(obj.Object, "spec", "type")
+			if svcType != "LoadBalancer" {
+				return true, nil
+			}
+		}
+		addresses = loadBalancerAddresses(obj)
+		return len(addresses) > 0, nil
+	})
+	return addresses, err
+}
+
+// loadBalancerAddresses returns the hostnames or IPs in `status.loadBalancer.ingress`.
+func loadBalancerAddresses(obj *unstructured.Unstructured) []string {
+	ingresses, _, _ := unstructured.NestedSlice(obj.Object, "status", "loadBalancer", "ingress")
+
+	var addresses []string
+	for _, v := range ingresses {
+		ingress, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if hostname, ok := ingress["hostname"].(string); ok && hostname != "" {
+			addresses = append(addresses, hostname)
+			continue
+		}
+		if ip, ok := ingress["ip"].(string); ok && ip != "" {
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses
+}
+
+// waitEstablished waits until the CRDs are established, so that their kinds can be discovered.
+func waitEstablished(
+	ctx context.Context,
+	dynamicClient dynamic.Interface,
+	mapping meta.RESTMapper,
+	crds []*unstructured.Unstructured,
+	timeout time.Duration,
+	requestTimeout time.Duration,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	eg := new(errgroup.Group)
+	for _, crd := range crds {
+		crd := crd
+		eg.Go(func() error {
+			resourceInter, _, err := newResourceInterface(dynamicClient, mapping, crd.GroupVersionKind(), "")
+			if err != nil {
+				return err
+			}
+			err = wait.PollImmediateUntilWithContext(ctx, waitInterval, func(ctx context.Context) (bool, error) {
+				obj, err := getWithTimeout(ctx, resourceInter, crd.GetName(), requestTimeout)
+				if err != nil {
+					return false, err
+				}
+				condition, ok := kube.FindCondition(obj, "Established")
+				return ok && condition.Status == "True", nil
+			})
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("wait for CustomResourceDefinition %s to be established timeout after %s", crd.GetName(), timeout)
+			}
+			if err != nil {
+				return fmt.Errorf("wait for CustomResourceDefinition %s to be established failed: %v", crd.GetName(), err)
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
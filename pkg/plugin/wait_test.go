@@ -0,0 +1,62 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestLoadBalancerAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		ingress []interface{}
+		want    []string
+	}{
+		{
+			name: "not assigned",
+		},
+		{
+			name: "ip and hostname",
+			ingress: []interface{}{
+				map[string]interface{}{"ip": "1.2.3.4"},
+				map[string]interface{}{"hostname": "lb.example.com", "ip": "5.6.7.8"},
+			},
+			want: []string{"1.2.3.4", "lb.example.com"},
+		},
+		{
+			name: "empty entries",
+			ingress: []interface{}{
+				map[string]interface{}{"ip": ""},
+				"invalid",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			if tt.ingress != nil {
+				if err := unstructured.SetNestedSlice(obj.Object, tt.ingress, "status", "loadBalancer", "ingress"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := loadBalancerAddresses(obj); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadBalancerAddresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redact
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Mask is used to replace the secret values.
+const Mask = "******"
+
+// minValueLength avoids masking common words like `true` everywhere.
+const minValueLength = 6
+
+// DefaultPatterns are the glob patterns of environment variable names whose values are secrets,
+// the names are matched case-insensitively.
+var DefaultPatterns = []string{
+	"*TOKEN*",
+	"*SECRET*",
+	"*PASSWORD*",
+	"*PASSWD*",
+	"*CREDENTIAL*",
+	"*PRIVATE_KEY*",
+	"*API_KEY*",
+	"*CA_CRT*",
+}
+
+type Redactor struct {
+	mu       sync.RWMutex
+	patterns []string
+	values   map[string]struct{}
+	replacer *strings.Replacer
+}
+
+// New returns a Redactor with DefaultPatterns and the given patterns.
+func New(patterns ...string) *Redactor {
+	r := &Redactor{values: make(map[string]struct{})}
+	for _, v := range append(DefaultPatterns[:len(DefaultPatterns):len(DefaultPatterns)], patterns...) {
+		v = strings.ToUpper(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		r.patterns = append(r.patterns, v)
+	}
+	return r
+}
+
+// MatchName reports whether the environment variable name matches any of the patterns.
+func (r *Redactor) MatchName(name string) bool {
+	name = strings.ToUpper(name)
+	for _, pattern := range r.patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AddValues registers the secret values and their base64 encodings,
+// since the values are usually encoded in the data of Secrets.
+func (r *Redactor) AddValues(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if len(v) < minValueLength {
+			continue
+		}
+		r.values[v] = struct{}{}
+		r.values[base64.StdEncoding.EncodeToString([]byte(v))] = struct{}{}
+	}
+
+	// replace longer values first, in case one value contains another.
+	list := make([]string, 0, len(r.values))
+	for v := range r.values {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return len(list[i]) > len(list[j])
+	})
+	oldnew := make([]string, 0, len(list)*2)
+	for _, v := range list {
+		oldnew = append(oldnew, v, Mask)
+	}
+	r.replacer = strings.NewReplacer(oldnew...)
+}
+
+// AddEnv registers the values of environment variables whose names match the patterns.
+func (r *Redactor) AddEnv(envMap map[string]string) {
+	values := make([]string, 0)
+	for k, v := range envMap {
+		if r.MatchName(k) {
+			values = append(values, v)
+		}
+	}
+	r.AddValues(values...)
+}
+
+// Redact replaces all the registered secret values in s, s is returned as is if r is nil.
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	r.mu.RLock()
+	replacer := r.replacer
+	r.mu.RUnlock()
+
+	if replacer == nil {
+		return s
+	}
+	return replacer.Replace(s)
+}
+
+// Formatter wraps the logrus formatter to redact the message and fields of log entries.
+func (r *Redactor) Formatter(formatter logrus.Formatter) logrus.Formatter {
+	return &redactFormatter{redactor: r, formatter: formatter}
+}
+
+type redactFormatter struct {
+	redactor  *Redactor
+	formatter logrus.Formatter
+}
+
+func (f *redactFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	current := entry.Dup()
+	current.Level = entry.Level
+	current.Caller = entry.Caller
+	current.Message = f.redactor.Redact(entry.Message)
+	for k, v := range current.Data {
+		switch val := v.(type) {
+		case string:
+			current.Data[k] = f.redactor.Redact(val)
+		case error:
+			current.Data[k] = f.redactor.Redact(val.Error())
+		default:
+			str := fmt.Sprint(val)
+			if redacted := f.redactor.Redact(str); redacted != str {
+				current.Data[k] = redacted
+			}
+		}
+	}
+
+	out, err := f.formatter.Format(current)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(f.redactor.Redact(string(out))), nil
+}
@@ -0,0 +1,124 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedactor_MatchName(t *testing.T) {
+	r := New("*_DSN")
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "PLUGIN_K8S_TOKEN", want: true},
+		{name: "plugin_kubernetes_ca_crt", want: true},
+		{name: "DB_PASSWORD", want: true},
+		{name: "MYSQL_DSN", want: true},
+		{name: "DRONE_COMMIT_SHA", want: false},
+		{name: "PLUGIN_NAMESPACE", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.MatchName(tt.name); got != tt.want {
+				t.Errorf("MatchName(%s) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactor_Redact(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		env    map[string]string
+		in     string
+		want   string
+	}{
+		{
+			name: "no values",
+			in:   "token abcdefgh",
+			want: "token abcdefgh",
+		},
+		{
+			name:   "registered value",
+			values: []string{"abcdefgh"},
+			in:     "token abcdefgh used twice abcdefgh",
+			want:   "token ****** used twice ******",
+		},
+		{
+			name:   "short values are ignored",
+			values: []string{"true", " abc "},
+			in:     "true abc",
+			want:   "true abc",
+		},
+		{
+			name:   "longer values first",
+			values: []string{"secret", "secret-suffix"},
+			in:     "secret-suffix secret",
+			want:   "****** ******",
+		},
+		{
+			name:   "base64 encodings",
+			values: []string{"s3cr3t-value"},
+			in:     "data: czNjcjN0LXZhbHVl",
+			want:   "data: ******",
+		},
+		{
+			name: "values of matched env names",
+			env:  map[string]string{"PLUGIN_K8S_TOKEN": "abcdefgh", "PLUGIN_NAMESPACE": "default-ns"},
+			in:   "token abcdefgh in default-ns",
+			want: "token ****** in default-ns",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New()
+			r.AddValues(tt.values...)
+			r.AddEnv(tt.env)
+			if got := r.Redact(tt.in); got != tt.want {
+				t.Errorf("Redact() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactor_Formatter(t *testing.T) {
+	r := New()
+	r.AddValues("abcdefgh")
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(r.Formatter(&logrus.JSONFormatter{}))
+	logger.WithField("token", "abcdefgh").
+		WithError(errors.New("invalid token abcdefgh")).
+		Info("login with abcdefgh")
+
+	out := buf.String()
+	if strings.Contains(out, "abcdefgh") {
+		t.Errorf("Format() = %s, the secret value is not redacted", out)
+	}
+	if strings.Count(out, Mask) != 3 {
+		t.Errorf("Format() = %s, want 3 masks", out)
+	}
+}
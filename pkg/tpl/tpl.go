@@ -16,9 +16,11 @@ package tpl
 
 import (
 	"bytes"
+	"fmt"
 	"text/template"
 
 	"github.com/Masterminds/sprig"
+	"github.com/a8m/envsubst/parse"
 
 	"github.com/zc2638/drone-k8s-plugin/pkg/constants"
 )
@@ -26,16 +28,39 @@ import (
 var tpl = template.New(constants.ProjectName).Funcs(sprig.TxtFuncMap())
 
 func Render(in []byte, envMap map[string]string) ([]byte, error) {
+	return RenderWithValues(in, envMap, nil)
+}
+
+// RenderWithValues renders the template with `.env` and `.values`.
+func RenderWithValues(in []byte, envMap map[string]string, values map[string]interface{}) ([]byte, error) {
 	t, err := tpl.Parse(string(in))
 	if err != nil {
 		return nil, err
 	}
 
+	data := map[string]interface{}{
+		"env":    envMap,
+		"values": values,
+	}
 	var buf bytes.Buffer
-	if err := t.Execute(&buf, map[string]interface{}{"env": envMap}); err != nil {
+	if err := t.Execute(&buf, data); err != nil {
 		return nil, err
 	}
 	current := buf.Bytes()
 	out := bytes.ReplaceAll(current, []byte("<no value>"), []byte(""))
 	return out, nil
 }
+
+// Envsubst only substitutes the environment variables like `${VAR}`,
+// and leaves the go template syntax as it is.
+func Envsubst(in []byte, envMap map[string]string) ([]byte, error) {
+	envs := make([]string, 0, len(envMap))
+	for k, v := range envMap {
+		envs = append(envs, fmt.Sprintf("%s=%s", k, v))
+	}
+	out, err := parse.New("string", envs, &parse.Restrictions{}).Parse(string(in))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
@@ -0,0 +1,98 @@
+// Copyright © 2022 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpl
+
+import "testing"
+
+func TestRenderWithValues(t *testing.T) {
+	envMap := map[string]string{"NAME": "app"}
+	values := map[string]interface{}{
+		"replicas": 3,
+		"image":    map[string]interface{}{"tag": "v1.0.0"},
+	}
+
+	tests := []struct {
+		name    string
+		in      string
+		values  map[string]interface{}
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "env and values",
+			in:     "name: {{ .env.NAME }}\nreplicas: {{ .values.replicas }}\ntag: {{ .values.image.tag | quote }}",
+			values: values,
+			want:   "name: app\nreplicas: 3\ntag: \"v1.0.0\"",
+		},
+		{
+			name: "missing values",
+			in:   "name: {{ .env.NAME }}{{ .values.replicas }}{{ .env.MISSING }}",
+			want: "name: app",
+		},
+		{
+			name:    "invalid template",
+			in:      "name: {{ .env.NAME",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RenderWithValues([]byte(tt.in), envMap, tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RenderWithValues() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("RenderWithValues() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvsubst(t *testing.T) {
+	envMap := map[string]string{"NAME": "app", "TAG": "v1.0.0"}
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "variables",
+			in:   "name: ${NAME}\nimage: nginx:$TAG",
+			want: "name: app\nimage: nginx:v1.0.0",
+		},
+		{
+			name: "default value",
+			in:   "replicas: ${REPLICAS:=2}",
+			want: "replicas: 2",
+		},
+		{
+			name: "go template untouched",
+			in:   "name: ${NAME}\nrule: '{{ .Labels.severity }}'\nenv: {{ .env.NAME }}",
+			want: "name: app\nrule: '{{ .Labels.severity }}'\nenv: {{ .env.NAME }}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Envsubst([]byte(tt.in), envMap)
+			if err != nil {
+				t.Fatalf("Envsubst() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Envsubst() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}